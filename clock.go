@@ -0,0 +1,180 @@
+package netem
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// Clock is the source of time used to schedule emulated traffic.
+//
+// The default is the system clock. Tests can substitute a [FakeClock] so that
+// emulating a long outage or a high-latency link takes no real time, and
+// timing assertions become exact.
+//
+// Alternatively, connections using the system clock may be created inside a
+// [testing/synctest] bubble: their background goroutines only block on
+// channels and timers, so they run in the bubble's virtual time and exit
+// when the connection is closed.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// NewTimer creates a new Timer that will send the current time on its
+	// channel after at least duration d.
+	NewTimer(d time.Duration) Timer
+	// Sleep pauses the current goroutine for at least the duration d.
+	Sleep(d time.Duration)
+}
+
+// Timer is a single event created by a [Clock], like [time.Timer].
+//
+// As with [time.Timer] since Go 1.23, no stale value is received from C after
+// Stop or Reset returns.
+type Timer interface {
+	// C returns the channel on which the time is delivered.
+	C() <-chan time.Time
+	// Stop prevents the Timer from firing. It returns false if the timer
+	// has already expired or been stopped.
+	Stop() bool
+	// Reset changes the timer to expire after duration d. It returns true if
+	// the timer had been active.
+	Reset(d time.Duration) bool
+}
+
+// clockOrDefault returns c, or the system clock if c is nil.
+func clockOrDefault(c Clock) Clock {
+	if c == nil {
+		return systemClock{}
+	}
+	return c
+}
+
+// systemClock is the [Clock] backed by package time.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                 { return time.Now() }
+func (systemClock) NewTimer(d time.Duration) Timer { return systemTimer{time.NewTimer(d)} }
+func (systemClock) Sleep(d time.Duration)          { time.Sleep(d) }
+
+type systemTimer struct{ *time.Timer }
+
+func (t systemTimer) C() <-chan time.Time { return t.Timer.C }
+
+// FakeClock is a [Clock] whose time only moves when advanced manually with
+// Advance. It is safe for concurrent use.
+type FakeClock struct {
+	mu     sync.Mutex
+	cond   sync.Cond // signaled when a timer is armed
+	now    time.Time
+	timers []*fakeTimer // active timers
+}
+
+// NewFakeClock returns a FakeClock whose current time is t.
+func NewFakeClock(t time.Time) *FakeClock {
+	c := &FakeClock{now: t}
+	c.cond.L = &c.mu
+	return c
+}
+
+// Now implements [Clock].
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// NewTimer implements [Clock].
+func (c *FakeClock) NewTimer(d time.Duration) Timer {
+	t := &fakeTimer{clock: c, ch: make(chan time.Time, 1)}
+	t.Reset(d)
+	return t
+}
+
+// Sleep implements [Clock]. It blocks until the clock has been advanced by
+// at least d.
+func (c *FakeClock) Sleep(d time.Duration) {
+	<-c.NewTimer(d).C()
+}
+
+// Advance moves the clock forward by d, firing every timer that expires in
+// the meantime in order of expiry.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	end := c.now.Add(d)
+	for len(c.timers) > 0 {
+		t := slices.MinFunc(c.timers, func(a, b *fakeTimer) int { return a.when.Compare(b.when) })
+		if t.when.After(end) {
+			break
+		}
+		c.now = later(c.now, t.when)
+		c.remove(t)
+		select {
+		case t.ch <- c.now:
+		default:
+		}
+	}
+	c.now = end
+}
+
+// BlockUntil blocks until at least n timers (including sleeping goroutines)
+// are waiting on the clock. It lets a test make sure that background work
+// has been scheduled before calling Advance.
+func (c *FakeClock) BlockUntil(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.timers) < n {
+		c.cond.Wait()
+	}
+}
+
+// remove deactivates t; c.mu must be held.
+func (c *FakeClock) remove(t *fakeTimer) bool {
+	i := slices.Index(c.timers, t)
+	if i < 0 {
+		return false
+	}
+	c.timers = slices.Delete(c.timers, i, i+1)
+	return true
+}
+
+// fakeTimer is a [Timer] created by a [FakeClock].
+type fakeTimer struct {
+	clock *FakeClock
+	ch    chan time.Time
+	when  time.Time
+}
+
+func (t *fakeTimer) C() <-chan time.Time { return t.ch }
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	t.drain()
+	return t.clock.remove(t)
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	c := t.clock
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t.drain()
+	active := c.remove(t)
+	t.when = c.now.Add(d)
+	if d <= 0 {
+		t.ch <- c.now
+		return active
+	}
+	c.timers = append(c.timers, t)
+	c.cond.Broadcast()
+	return active
+}
+
+// drain discards a pending value, so that none is received after Stop or
+// Reset; the clock's mutex must be held.
+func (t *fakeTimer) drain() {
+	select {
+	case <-t.ch:
+	default:
+	}
+}
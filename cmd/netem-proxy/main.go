@@ -0,0 +1,363 @@
+// Command netem-proxy is a TCP or UDP proxy that emulates network conditions,
+// for testing programs that are not written in Go, such as mobile apps,
+// browsers or databases.
+//
+// It listens on a local address, forwards every connection (or, for UDP,
+// every client) to an upstream address, and emulates a link with the given
+// characteristics in both directions:
+//
+//	netem-proxy -listen 127.0.0.1:15432 -upstream 127.0.0.1:5432 \
+//		-latency 50ms -jitter 10ms -bandwidth 10M -loss 0.01
+//
+// Latency, jitter, bandwidth and loss apply to each direction separately, so
+// that a latency of 50ms adds 100ms to the round-trip time.
+//
+// Usage:
+//
+//	netem-proxy [flags]
+//
+// The flags are:
+//
+//	-listen address
+//		local address to listen on (default "127.0.0.1:0")
+//	-upstream address
+//		address to forward to (required)
+//	-proto tcp|udp
+//		protocol to proxy (default "tcp")
+//	-latency duration
+//		one-way propagation delay
+//	-jitter duration
+//		random variation of the latency, in [-jitter, +jitter]
+//	-bandwidth rate
+//		bandwidth in bits per second, with an optional k, M or G suffix
+//	-loss rate
+//		packet loss rate (0.0 to 1.0); lost TCP segments are retransmitted
+//	-mtu bytes
+//		maximum transmission unit (default 1500)
+//	-corrupt rate
+//		byte error rate (0.0 to 1.0)
+//	-duplicate rate
+//		UDP datagram duplication rate (0.0 to 1.0)
+//	-reorder rate
+//		rate of UDP datagrams sent ahead of others (0.0 to 1.0)
+//	-linger duration
+//		how long closing a TCP connection waits for queued data (default 10s)
+//	-udp-timeout duration
+//		how long an idle UDP session is kept (default 2m)
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kasader/netem"
+	"github.com/kasader/netem/policy"
+)
+
+// Errors returned by parseFlags.
+var (
+	errUnexpectedArg = errors.New("unexpected argument")
+	errNoUpstream    = errors.New("-upstream is required")
+	errInvalidFlag   = errors.New("invalid flag")
+	errInvalidRate   = errors.New("not a positive rate")
+)
+
+// config is the configuration of the proxy, set from the command line.
+type config struct {
+	listen     string
+	upstream   string
+	proto      string
+	udpTimeout time.Duration
+
+	stream netem.StreamProfile
+	packet netem.PacketProfile
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("netem-proxy: ")
+	cfg, err := parseFlags(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if err := run(ctx, cfg); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// parseFlags parses the command line into a config.
+func parseFlags(fs *flag.FlagSet, args []string) (*config, error) {
+	var (
+		cfg                               config
+		latency, jitter, linger           time.Duration
+		bandwidth                         string
+		loss, corrupt, duplicate, reorder float64
+		mtu                               uint
+	)
+	fs.StringVar(&cfg.listen, "listen", "127.0.0.1:0", "local `address` to listen on")
+	fs.StringVar(&cfg.upstream, "upstream", "", "`address` to forward to (required)")
+	fs.StringVar(&cfg.proto, "proto", "tcp", "protocol to proxy: tcp or udp")
+	fs.DurationVar(&latency, "latency", 0, "one-way propagation delay")
+	fs.DurationVar(&jitter, "jitter", 0, "random variation of the latency, in [-jitter, +jitter]")
+	fs.StringVar(&bandwidth, "bandwidth", "",
+		"bandwidth in bits per second, with an optional k, M or G suffix (unlimited if empty)")
+	fs.Float64Var(&loss, "loss", 0,
+		"packet loss `rate` (0.0 to 1.0); lost TCP segments are retransmitted")
+	fs.UintVar(&mtu, "mtu", netem.EthernetDefaultMTU, "maximum transmission unit, in `bytes`")
+	fs.Float64Var(&corrupt, "corrupt", 0, "byte error `rate` (0.0 to 1.0)")
+	fs.Float64Var(&duplicate, "duplicate", 0, "UDP datagram duplication `rate` (0.0 to 1.0)")
+	fs.Float64Var(&reorder, "reorder", 0,
+		"`rate` of UDP datagrams sent ahead of others (0.0 to 1.0)")
+	fs.DurationVar(&linger, "linger", 10*time.Second,
+		"how long closing a TCP connection waits for queued data")
+	fs.DurationVar(&cfg.udpTimeout, "udp-timeout", 2*time.Minute,
+		"how long an idle UDP session is kept")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("%w %q", errUnexpectedArg, fs.Arg(0))
+	}
+	if cfg.upstream == "" {
+		return nil, errNoUpstream
+	}
+	if cfg.proto != "tcp" && cfg.proto != "udp" {
+		return nil, fmt.Errorf("%w -proto %q: must be tcp or udp", errInvalidFlag, cfg.proto)
+	}
+	rates := map[string]float64{
+		"loss":      loss,
+		"corrupt":   corrupt,
+		"duplicate": duplicate,
+		"reorder":   reorder,
+	}
+	for name, rate := range rates {
+		if rate < 0 || rate > 1 {
+			return nil, fmt.Errorf("%w -%s %v: must be between 0 and 1", errInvalidFlag, name, rate)
+		}
+	}
+
+	link := netem.LinkProfile{MTU: mtu}
+	if latency > 0 {
+		link.Latency = policy.StaticLatency(latency)
+	}
+	if jitter > 0 {
+		link.Jitter = policy.RandomJitter(jitter)
+	}
+	if bandwidth != "" {
+		bps, err := parseBandwidth(bandwidth)
+		if err != nil {
+			return nil, fmt.Errorf("%w -bandwidth: %w", errInvalidFlag, err)
+		}
+		link.Bandwidth = policy.StaticBandwidth(bps)
+	}
+	if loss > 0 {
+		link.Loss = policy.RandomLoss(loss)
+	}
+	cfg.stream = netem.StreamProfile{
+		MTU:       link.MTU,
+		Latency:   link.Latency,
+		Jitter:    link.Jitter,
+		Bandwidth: link.Bandwidth,
+		Loss:      link.Loss,
+		Linger:    linger,
+	}
+	cfg.packet = netem.PacketProfile{
+		MTU:       link.MTU,
+		Latency:   link.Latency,
+		Jitter:    link.Jitter,
+		Bandwidth: link.Bandwidth,
+		Loss:      link.Loss,
+		// Clients expect the proxy to behave like a router.
+		Oversize: netem.OversizeFragment,
+	}
+	if corrupt > 0 {
+		cfg.stream.Corrupt = policy.ByteErrorRate(corrupt)
+		cfg.packet.Corrupt = policy.ByteErrorRate(corrupt)
+	}
+	if duplicate > 0 {
+		cfg.packet.Duplicate = policy.RandomDuplicate(duplicate, 0)
+	}
+	if reorder > 0 {
+		cfg.packet.Reorder = policy.RandomReorder(reorder, 0, 0)
+	}
+	return &cfg, nil
+}
+
+// parseBandwidth parses a rate in bits per second, such as "512k" or "10M".
+func parseBandwidth(s string) (uint64, error) {
+	mult := uint64(1)
+	switch {
+	case strings.HasSuffix(s, "k"), strings.HasSuffix(s, "K"):
+		mult = 1e3
+	case strings.HasSuffix(s, "M"):
+		mult = 1e6
+	case strings.HasSuffix(s, "G"):
+		mult = 1e9
+	}
+	if mult > 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("%w: %q", errInvalidRate, s)
+	}
+	return uint64(n * float64(mult)), nil
+}
+
+// run listens and proxies until ctx is done.
+func run(ctx context.Context, cfg *config) error {
+	if cfg.proto == "udp" {
+		pc, err := net.ListenPacket("udp", cfg.listen)
+		if err != nil {
+			return err
+		}
+		log.Printf("proxying udp %v to %s", pc.LocalAddr(), cfg.upstream)
+		return serveUDP(ctx, pc, cfg)
+	}
+	l, err := net.Listen("tcp", cfg.listen)
+	if err != nil {
+		return err
+	}
+	log.Printf("proxying tcp %v to %s", l.Addr(), cfg.upstream)
+	return serveTCP(ctx, l, cfg)
+}
+
+// serveTCP accepts connections on l and proxies each one to the upstream
+// address, until ctx is done.
+func serveTCP(ctx context.Context, l net.Listener, cfg *config) error {
+	l = netem.NewListener(l, cfg.stream)
+	stop := context.AfterFunc(ctx, func() { l.Close() })
+	defer stop()
+	dialer := &netem.Dialer{Stream: cfg.stream}
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		down, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		wg.Go(func() {
+			defer down.Close()
+			up, err := dialer.DialContext(ctx, "tcp", cfg.upstream)
+			if err != nil {
+				log.Printf("%v: %v", down.RemoteAddr(), err)
+				return
+			}
+			defer up.Close()
+			stop := context.AfterFunc(ctx, func() {
+				down.Close()
+				up.Close()
+			})
+			defer stop()
+
+			var copies sync.WaitGroup
+			copies.Go(func() { forward(up, down) })
+			forward(down, up)
+			copies.Wait()
+		})
+	}
+}
+
+// forward copies src to dst until EOF, then passes the half-close on to dst.
+func forward(dst, src net.Conn) {
+	io.Copy(dst, src)
+	if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	} else {
+		dst.Close()
+	}
+}
+
+// serveUDP proxies the datagrams received on pc to the upstream address,
+// until ctx is done. Each client address gets its own session: an upstream
+// socket, whose replies are sent back to the client, and its own emulated
+// path in each direction.
+func serveUDP(ctx context.Context, pc net.PacketConn, cfg *config) error {
+	down := netem.NewPacketConnPerDestination(pc, &netem.DestinationProfiles{Default: cfg.packet})
+	stop := context.AfterFunc(ctx, func() { down.Close() })
+	defer stop()
+	dialer := &netem.Dialer{Packet: cfg.packet}
+
+	var (
+		mu       sync.Mutex
+		sessions = make(map[string]net.Conn)
+		wg       sync.WaitGroup
+	)
+	defer wg.Wait()
+	defer func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, up := range sessions {
+			up.Close()
+		}
+	}()
+
+	buf := make([]byte, 64<<10)
+	for {
+		n, client, err := down.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		key := client.String()
+		mu.Lock()
+		up, ok := sessions[key]
+		mu.Unlock()
+		if !ok {
+			if up, err = dialer.DialContext(ctx, "udp", cfg.upstream); err != nil {
+				log.Printf("%v: %v", client, err)
+				continue
+			}
+			mu.Lock()
+			sessions[key] = up
+			mu.Unlock()
+			wg.Go(func() {
+				relayReplies(down, up, client, cfg.udpTimeout)
+				mu.Lock()
+				delete(sessions, key)
+				mu.Unlock()
+				up.Close()
+			})
+		}
+		up.SetReadDeadline(time.Now().Add(cfg.udpTimeout))
+		if _, err := up.Write(buf[:n]); err != nil {
+			log.Printf("%v: %v", client, err)
+		}
+	}
+}
+
+// relayReplies sends the datagrams received on up back to client through
+// down, until the session has been idle for timeout.
+func relayReplies(down net.PacketConn, up net.Conn, client net.Addr, timeout time.Duration) {
+	buf := make([]byte, 64<<10)
+	for {
+		n, err := up.Read(buf)
+		if err != nil {
+			return
+		}
+		up.SetReadDeadline(time.Now().Add(timeout))
+		if _, err := down.WriteTo(buf[:n], client); err != nil {
+			return
+		}
+	}
+}
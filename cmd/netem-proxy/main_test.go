@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseBandwidth(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want uint64
+	}{
+		{"8000", 8000},
+		{"512k", 512_000},
+		{"1.5M", 1_500_000},
+		{"1G", 1_000_000_000},
+	} {
+		if got, err := parseBandwidth(tt.in); err != nil || got != tt.want {
+			t.Errorf("parseBandwidth(%q) = %v, %v; want %v", tt.in, got, err, tt.want)
+		}
+	}
+	for _, in := range []string{"", "M", "-1k", "fast"} {
+		if _, err := parseBandwidth(in); err == nil {
+			t.Errorf("parseBandwidth(%q) succeeded, want an error", in)
+		}
+	}
+}
+
+// mustParseFlags parses args into a config, or fails the test.
+func mustParseFlags(t *testing.T, args ...string) *config {
+	t.Helper()
+	cfg, err := parseFlags(flag.NewFlagSet("netem-proxy", flag.ContinueOnError), args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func TestProxy_TCP(t *testing.T) {
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	go func() {
+		for {
+			c, err := upstream.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+
+	const latency = 20 * time.Millisecond
+	cfg := mustParseFlags(t, "-upstream", upstream.Addr().String(), "-latency", latency.String())
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- serveTCP(ctx, l, cfg) }()
+	defer func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	}()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	start := time.Now()
+	msg := []byte("hello, upstream")
+	if _, err := c.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	c.(*net.TCPConn).CloseWrite()
+	got, err := io.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Errorf("echo = %q, want %q", got, msg)
+	}
+	// Handshake with the upstream, then the echo round trip.
+	if elapsed, want := time.Since(start), 4*latency; elapsed < want {
+		t.Errorf("echo took %v, want at least %v", elapsed, want)
+	}
+}
+
+func TestProxy_UDP(t *testing.T) {
+	upstream, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := upstream.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			upstream.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	const latency = 20 * time.Millisecond
+	cfg := mustParseFlags(t, "-proto", "udp",
+		"-upstream", upstream.LocalAddr().String(), "-latency", latency.String())
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- serveUDP(ctx, pc, cfg) }()
+	defer func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	}()
+
+	// Each client gets its own replies.
+	for _, msg := range []string{"first client", "second client"} {
+		c, err := net.Dial("udp", pc.LocalAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		start := time.Now()
+		if _, err := c.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 1500)
+		n, err := c.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(buf[:n]); got != msg {
+			t.Errorf("echo = %q, want %q", got, msg)
+		}
+		if elapsed, want := time.Since(start), 2*latency; elapsed < want {
+			t.Errorf("echo took %v, want at least %v", elapsed, want)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package netem
+
+import (
+	"cmp"
+	"container/heap"
+	"math"
+	"time"
+)
+
+// CongestionControl selects the congestion-control algorithm that limits how
+// many bytes a [Conn] may have in flight (unacknowledged) at any time.
+//
+// Without one, a Conn sends at the full configured bandwidth from the first
+// byte. With one, short transfers ramp up through slow start and throughput
+// backs off after (emulated) loss, as with a real TCP sender.
+//
+// A CongestionControl value is configuration only: every connection builds
+// its own window state from it.
+type CongestionControl interface {
+	newWindow(mss int) *congestionWindow
+}
+
+// defaultInitialWindow is the initial window in segments (RFC 6928).
+const defaultInitialWindow = 10
+
+// Reno is the classic TCP Reno algorithm: the window doubles every round trip
+// in slow start, grows by one segment per round trip in congestion
+// avoidance, and is halved on loss.
+type Reno struct {
+	// InitialWindow is the initial congestion window in segments.
+	//
+	// Defaults to 10 if 0.
+	InitialWindow int
+}
+
+func (r Reno) newWindow(mss int) *congestionWindow {
+	return newCongestionWindow(mss, r.InitialWindow, 0.5, nil)
+}
+
+// CUBIC is the default algorithm of Linux, macOS and Windows (RFC 9438).
+// After a loss, the window grows along a cubic curve that plateaus around
+// the window size at which the loss occurred.
+type CUBIC struct {
+	// InitialWindow is the initial congestion window in segments.
+	//
+	// Defaults to 10 if 0.
+	InitialWindow int
+	// C is the scaling constant of the cubic curve.
+	//
+	// Defaults to 0.4 if 0.
+	C float64
+	// Beta is the multiplicative decrease factor applied on loss.
+	//
+	// Defaults to 0.7 if 0.
+	Beta float64
+}
+
+func (c CUBIC) newWindow(mss int) *congestionWindow {
+	beta := cmp.Or(c.Beta, 0.7)
+	return newCongestionWindow(mss, c.InitialWindow, beta, &cubicState{
+		c:    cmp.Or(c.C, 0.4),
+		beta: beta,
+	})
+}
+
+// congestionWindow tracks the congestion window of a sender in virtual time.
+//
+// Segments are acknowledged one round trip after they are sent; since the
+// emulated timeline is known in advance, acknowledgements are processed
+// lazily whenever the sender wants to transmit.
+type congestionWindow struct {
+	mss      float64
+	cwnd     float64 // in bytes
+	ssthresh float64 // in bytes
+	beta     float64
+	cubic    *cubicState // nil for Reno
+
+	inflight      ackHeap
+	inflightBytes int       // including unresolved bytes
+	unresolved    int       // bytes in flight whose acknowledgement time is unknown
+	lastAck       time.Time // acknowledgement of the last segment sent
+	recovery      time.Time // until then, losses belong to the last loss event
+}
+
+func newCongestionWindow(mss, initial int, beta float64, cubic *cubicState) *congestionWindow {
+	return &congestionWindow{
+		mss:      float64(mss),
+		cwnd:     float64(mss * cmp.Or(initial, defaultInitialWindow)),
+		ssthresh: math.Inf(1),
+		beta:     beta,
+		cubic:    cubic,
+	}
+}
+
+// wait returns the earliest time at or after start when size bytes fit in
+// the congestion window. It returns false if that depends on segments whose
+// acknowledgement time is not known yet.
+func (w *congestionWindow) wait(start time.Time, size int) (time.Time, bool) {
+	w.ackUntil(start)
+	for float64(w.inflightBytes+size) > w.cwnd {
+		if w.inflight.Len() == 0 {
+			return start, w.unresolved == 0
+		}
+		// The window is full: wait for the next acknowledgement.
+		start = later(start, w.inflight[0].at)
+		w.ackUntil(start)
+	}
+	return start, true
+}
+
+// sent records a segment of size bytes, acknowledged at ackAt. If the segment
+// was lost (and retransmitted), the window is decreased at time lostAt.
+//
+// As in Reno and CUBIC, the window is only decreased once per loss event:
+// losses are ignored until every segment in flight at the first one, like
+// the recovery point of RFC 6582, has been acknowledged.
+func (w *congestionWindow) sent(size int, ackAt time.Time, lost bool, lostAt time.Time) {
+	w.lastAck = later(w.lastAck, ackAt)
+	if lost && !lostAt.Before(w.recovery) {
+		w.onLoss(lostAt)
+		w.recovery = w.lastAck
+	}
+	heap.Push(&w.inflight, ack{at: ackAt, size: size})
+	w.inflightBytes += size
+}
+
+// submitted records a segment of size bytes whose acknowledgement time is not
+// known yet, such as one queued in a Link with a Scheduler. It holds its place
+// in the window until resolved reports its outcome.
+func (w *congestionWindow) submitted(size int) {
+	w.inflightBytes += size
+	w.unresolved += size
+}
+
+// resolved records the outcome of a segment of size bytes counted by
+// submitted, like sent.
+func (w *congestionWindow) resolved(size int, ackAt time.Time, lost bool, lostAt time.Time) {
+	w.inflightBytes -= size
+	w.unresolved -= size
+	w.sent(size, ackAt, lost, lostAt)
+}
+
+// ackUntil processes every acknowledgement received by time now.
+func (w *congestionWindow) ackUntil(now time.Time) {
+	for w.inflight.Len() > 0 && !w.inflight[0].at.After(now) {
+		a := heap.Pop(&w.inflight).(ack)
+		w.inflightBytes -= a.size
+		w.onAck(a.size, a.at)
+	}
+}
+
+func (w *congestionWindow) onAck(acked int, now time.Time) {
+	if w.cwnd < w.ssthresh {
+		// Slow start: grow by the number of bytes acknowledged.
+		w.cwnd += float64(acked)
+		return
+	}
+	if w.cubic != nil {
+		w.cwnd = w.cubic.onAck(w.cwnd, w.mss, float64(acked), now)
+		return
+	}
+	// Congestion avoidance: grow by one segment per window acknowledged.
+	w.cwnd += w.mss * float64(acked) / w.cwnd
+}
+
+func (w *congestionWindow) onLoss(now time.Time) {
+	if w.cubic != nil {
+		w.cubic.onLoss(w.cwnd, w.mss, now)
+	}
+	w.cwnd = max(w.cwnd*w.beta, 2*w.mss)
+	w.ssthresh = w.cwnd
+}
+
+// cubicState holds the state of the CUBIC window growth function.
+type cubicState struct {
+	c    float64
+	beta float64
+
+	wMax       float64 // window before the last reduction, in segments
+	k          float64 // time to reach wMax again, in seconds
+	epochStart time.Time
+}
+
+func (s *cubicState) onLoss(cwnd, mss float64, now time.Time) {
+	s.wMax = cwnd / mss
+	s.k = math.Cbrt(s.wMax * (1 - s.beta) / s.c)
+	s.epochStart = now
+}
+
+// onAck returns the new window after acked bytes are acknowledged in
+// congestion avoidance, following W(t) = C(t-K)³ + Wmax.
+func (s *cubicState) onAck(cwnd, mss, acked float64, now time.Time) float64 {
+	if s.epochStart.IsZero() {
+		// Congestion avoidance without a prior loss: plateau here.
+		s.onLoss(cwnd/s.beta, mss, now)
+	}
+	t := now.Sub(s.epochStart).Seconds()
+	target := (s.c*math.Pow(t-s.k, 3) + s.wMax) * mss
+	if target > cwnd {
+		return cwnd + (target-cwnd)*acked/cwnd
+	}
+	// Around the plateau, probe very slowly.
+	return cwnd + 0.01*mss*acked/cwnd
+}
+
+// ack is an acknowledgement expected at a given time.
+type ack struct {
+	at   time.Time
+	size int
+}
+
+// ackHeap is a Min-Heap of acknowledgements sorted by time.
+type ackHeap []ack
+
+func (h ackHeap) Len() int           { return len(h) }
+func (h ackHeap) Less(i, j int) bool { return h[i].at.Before(h[j].at) }
+func (h ackHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *ackHeap) Push(x any) {
+	*h = append(*h, x.(ack))
+}
+
+func (h *ackHeap) Pop() any {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[0 : n-1]
+	return x
+}
+
+// later returns the later of a and b.
+func later(a, b time.Time) time.Time {
+	if b.After(a) {
+		return b
+	}
+	return a
+}
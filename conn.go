@@ -1,10 +1,13 @@
 package netem
 
 import (
+	"cmp"
+	"errors"
 	"net"
 	"os"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -20,11 +23,104 @@ type StreamProfile struct {
 	Jitter    Jitter
 	Bandwidth Bandwidth
 	Fault     Fault
+	Corrupt   Corrupt
+
+	// Loss emulates segment loss. As a stream cannot drop bytes, a lost
+	// segment is instead retransmitted after a retransmission timeout (RTO),
+	// which doubles every time the same segment is lost again, and blocks the
+	// segments behind it (head-of-line blocking). Once a segment has been
+	// lost too many times, the connection times out.
+	Loss Loss
+
+	// MinRTO is added to the round-trip time to compute the initial RTO of a
+	// lost segment, as in Linux.
+	//
+	// Defaults to 200ms if 0.
+	MinRTO time.Duration
+
+	// Clock schedules the delivery of data and is used to check write
+	// deadlines. Use a [FakeClock] to run tests in fake time.
+	//
+	// Defaults to the system clock if nil.
+	Clock Clock
+
+	// Congestion limits the number of bytes in flight per round trip, where
+	// the round-trip time is twice the one-way Latency and Jitter. Lost
+	// segments (see Loss) shrink the window.
+	//
+	// If Link has a [Scheduler], losses and queueing at the Link count too,
+	// and Write blocks while the window is full of segments queued there.
+	//
+	// Disabled if nil: data is sent at the full Bandwidth from the start.
+	Congestion CongestionControl
+
+	// ShortRead limits how many bytes each Read returns, even when more data
+	// is available, to exercise code that assumes a Read returns a whole
+	// message (instead of using io.ReadFull).
+	//
+	// Disabled if nil.
+	ShortRead ShortRead
+
+	// Linger is how long Close waits for queued data to be delivered at its
+	// due time before closing the underlying connection, like SO_LINGER.
+	//
+	// If 0, queued data is discarded immediately. If negative, Close waits
+	// until all queued data has been delivered.
+	Linger time.Duration
+
+	// Weight is the share of the Link's bandwidth the connection gets
+	// relative to others, if the Link's Scheduler is [DRR] or [WFQ].
+	//
+	// Defaults to 1 if 0.
+	Weight int
+
+	// Priority is the priority class of the connection, if the Link's
+	// Scheduler is [StrictPriority]. Lower values are served first.
+	Priority int
+
+	// Link attaches the connection to a [Link] shared with other
+	// connections: after the emulation above, data also crosses the Link,
+	// sharing its wire and bandwidth with all other traffic over it.
+	//
+	// Disabled if nil.
+	Link *Link
+
+	route route // Link, then the links of a Network topology
+}
+
+// links returns the links crossed by the connection: its Link, if any, then
+// the links of its route.
+func (p StreamProfile) links() route {
+	if p.Link == nil {
+		return p.route
+	}
+	return append(route{p.Link}, p.route...)
 }
 
+// Retransmission limits, matching the Linux defaults.
+const (
+	defaultMinRTO  = 200 * time.Millisecond
+	maxRTO         = 120 * time.Second
+	maxRetransmits = 15 // net.ipv4.tcp_retries2
+)
+
+// ErrDataDiscarded is returned by Close when the linger timeout expired
+// before all queued data could be delivered.
+var ErrDataDiscarded = errors.New("netem: close discarded queued data")
+
 type writeReq struct {
 	data []byte
 	due  time.Time
+	eof  bool // half-close the connection instead of writing data
+
+	timedOut bool        // retransmissions were exhausted; the connection times out
+	ticket   *linkPacket // the segment waiting in a scheduled Link, due at the Link
+
+	// For a segment in a scheduled Link, what the congestion window needs
+	// once its ticket is resolved.
+	sentAt   time.Time     // when it left the connection's own wire
+	ackDelay time.Duration // one-way delay of its acknowledgement
+	lost     bool          // lost (and retransmitted) before reaching the Link
 }
 
 // Conn wraps an existing [net.Conn] to emulate network conditions for
@@ -34,28 +130,56 @@ type writeReq struct {
 // to ensure that data is written to the underlying socket in the exact
 // order it was received from the application, even in the presence of
 // latency and jitter.
+//
+// Writes are split into segments of at most the MSS (the MTU minus headers),
+// each delivered at its own due time, so the peer observes data trickling in
+// as it would on a real link rather than in the application's write sizes.
+//
+// Because data is written to the underlying socket asynchronously, a failed
+// delivery is recorded and returned by every subsequent Write and by Close,
+// much like a kernel socket reports a previous failure.
 type Conn struct {
 	net.Conn
 	headerSize    int
 	mss           int // maximum segment size used for bandwidth calculations
 	p             StreamProfile
+	clock         Clock
 	writeCh       chan writeReq // writeCh acts as a FIFO queue to prevent stream reordering.
 	writeDeadline atomic.Value
 	mu            sync.Mutex
 	nextWireTime  time.Time // Tracks when the next segment can be physically sent
+	cwnd          *congestionWindow
+	flow          *linkFlow     // flow in a Link with a Scheduler
+	resolved      chan struct{} // closed and replaced when a ticket is resolved; guarded by mu
+	errMu         sync.Mutex
+	err           error        // first error encountered by the link loop
+	readOffset    atomic.Int64 // stream offset of the next byte to read
+	closing       atomic.Bool
+	writeClosed   atomic.Bool
+	closeOnce     sync.Once
 	stopOnce      sync.Once
-	stopCh        chan struct{}
+	stopCh        chan struct{} // stopCh aborts the link loop.
+	drainCh       chan struct{} // drainCh asks the link loop to exit once writeCh is empty.
+	doneCh        chan struct{} // doneCh is closed when the link loop exits.
 }
 
 // NewConn wraps an existing net.Conn to emulate network conditions for stream-oriented
 // protocols like TCP. It ensures that data order is strictly preserved even when
 // jitter or latency is applied.
+//
+// If c supports half-close (like [*net.TCPConn] and [*net.UnixConn]), so does
+// the returned connection: CloseWrite takes effect once all data written
+// before it has been delivered, and CloseRead is passed through. If c is a
+// [*net.TCPConn] or [*net.UnixConn], the returned connection is a [*TCPConn]
+// or [*UnixConn] that preserves the methods of c.
 func NewConn(c net.Conn, p StreamProfile) net.Conn {
+	p.route = p.links()
 	headerSize := getHeaderSize(c.LocalAddr())
 	mtu := p.MTU
 	if mtu == 0 {
 		mtu = EthernetDefaultMTU
 	}
+	mtu = p.route.clampMTU(mtu)
 	// Enforce minimum mss (prevent infinite loop).
 	mss := max(1, int(mtu)-headerSize)
 
@@ -64,28 +188,103 @@ func NewConn(c net.Conn, p StreamProfile) net.Conn {
 		headerSize: headerSize,
 		mss:        mss,
 		p:          p,
+		clock:      clockOrDefault(p.Clock),
 
 		// Buffered to allow bursting.
 		// TODO: Should the WriteCh length be configurable?
 		writeCh: make(chan writeReq, 1024),
 		stopCh:  make(chan struct{}),
+		drainCh: make(chan struct{}),
+		doneCh:  make(chan struct{}),
+	}
+	if p.Congestion != nil {
+		nc.cwnd = p.Congestion.newWindow(mss)
+	}
+	if p.Link != nil && p.Link.sched != nil {
+		nc.flow = p.Link.attach(p.Weight, p.Priority)
+		nc.resolved = make(chan struct{})
 	}
 	nc.writeDeadline.Store(time.Time{})
 	go nc.linkLoop()
+
+	switch c := c.(type) {
+	case *net.TCPConn:
+		return &TCPConn{Conn: nc, tc: c}
+	case *net.UnixConn:
+		return &UnixConn{Conn: nc, uc: c}
+	case interface {
+		closeWriter
+		closeReader
+	}:
+		return &halfCloseConn{nc}
+	case closeWriter:
+		return &closeWriteConn{nc}
+	}
 	return nc
 }
 
 // Close implements net.Conn.
+//
+// If the profile sets a Linger duration, Close first waits for queued data to
+// be delivered. Should the linger timeout expire, the remaining data is
+// discarded and Close returns [ErrDataDiscarded].
 func (c *Conn) Close() error {
-	c.stopOnce.Do(func() {
-		if c.stopCh != nil {
-			// TODO: if this channel is closed before we
-			// return from c.Conn.Close() we could fail
-			// to return an error in Write()
-			close(c.stopCh)
-		}
+	delivered := true
+	c.closeOnce.Do(func() {
+		// The link loop may stop on its own while lingering (see sever), so
+		// stopping is separate from closing.
+		delivered = c.linger()
+		// TODO: if this channel is closed before we
+		// return from c.Conn.Close() we could fail
+		// to return an error in Write()
+		c.stop()
 	})
-	return c.Conn.Close()
+	closeErr := c.Conn.Close()
+	// A severed connection was already closed; report why rather than the
+	// failure to close it again.
+	if err := c.loadErr(); err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+	if !delivered {
+		return ErrDataDiscarded
+	}
+	return nil
+}
+
+// linger waits for the link loop to drain the write queue, as configured by
+// the profile's Linger duration. It reports whether all data was delivered.
+func (c *Conn) linger() bool {
+	if c.p.Linger == 0 {
+		return true
+	}
+	c.closing.Store(true)
+	close(c.drainCh)
+	if c.p.Linger < 0 {
+		<-c.doneCh
+		return true
+	}
+	timer := c.clock.NewTimer(c.p.Linger)
+	defer timer.Stop()
+	select {
+	case <-c.doneCh:
+		return true
+	case <-timer.C():
+		return false
+	}
+}
+
+// Read implements net.Conn.
+func (c *Conn) Read(b []byte) (n int, err error) {
+	if c.p.ShortRead != nil && len(b) > 1 {
+		limit := c.p.ShortRead.Limit(c.readOffset.Load(), len(b))
+		b = b[:min(max(limit, 1), len(b))]
+	}
+	n, err = c.Conn.Read(b)
+	c.readOffset.Add(int64(n))
+	return n, err
 }
 
 // SetDeadline implements net.Conn.
@@ -105,17 +304,29 @@ func (c *Conn) Write(b []byte) (n int, err error) {
 	if c.isWriteDeadline() {
 		return 0, os.ErrDeadlineExceeded
 	}
+	if c.closing.Load() {
+		return 0, c.opError("write", net.ErrClosed)
+	}
+	if c.writeClosed.Load() {
+		return 0, c.opError("write", syscall.EPIPE)
+	}
+	if err := c.loadErr(); err != nil {
+		return 0, err
+	}
 
 	sent := 0
 	for sent < len(b) {
-		chunkSize := min(len(b), c.mss)
-		finishTime := c.reserveWire(chunkSize)
-		arrival := finishTime.Add(delayTime(c.p.Latency, c.p.Jitter))
-		req := writeReq{
-			data: make([]byte, len(b)),
-			due:  arrival,
+		chunkSize := min(len(b)-sent, c.mss)
+		// Each request carries exactly one segment, so the peer observes the
+		// data arriving in MSS-sized pieces at each segment's due time.
+		req, ok := c.sendSegment(chunkSize)
+		if !ok {
+			// Stopped while waiting for the congestion window.
+			nRaw, errRaw := c.Conn.Write(b[sent:])
+			return sent + nRaw, errRaw
 		}
-		copy(req.data, b)
+		req.data = make([]byte, chunkSize)
+		copy(req.data, b[sent:])
 
 		select {
 		case <-c.stopCh:
@@ -131,32 +342,280 @@ func (c *Conn) Write(b []byte) (n int, err error) {
 
 var _ net.Conn = (*Conn)(nil)
 
+// retransmissionDelay applies the loss policy to a segment with the given
+// one-way delay, returning the time spent waiting for retransmission
+// timeouts, and whether the connection timed out in the process.
+func (c *Conn) retransmissionDelay(delay time.Duration) (time.Duration, bool) {
+	if c.p.Loss == nil {
+		return 0, false
+	}
+	rto := 2*delay + cmp.Or(c.p.MinRTO, defaultMinRTO)
+	var stall time.Duration
+	for range maxRetransmits + 1 {
+		if !c.p.Loss.Drop() {
+			return stall, false
+		}
+		stall += rto
+		rto = min(2*rto, maxRTO)
+	}
+	return stall, true
+}
+
+type closeWriter interface{ CloseWrite() error }
+
+type closeReader interface{ CloseRead() error }
+
+// closeWrite queues a half-close behind all previously written data.
+func (c *Conn) closeWrite() error {
+	if c.writeClosed.Swap(true) {
+		return nil
+	}
+	// The FIN travels the link like any other segment.
+	req := writeReq{
+		due: c.reserveWire(0).Add(delayTime(c.p.Latency, c.p.Jitter) + c.p.route.delay()),
+		eof: true,
+	}
+	select {
+	case <-c.stopCh:
+		return c.Conn.(closeWriter).CloseWrite()
+	case c.writeCh <- req:
+		return nil
+	}
+}
+
+// halfCloseConn is a [Conn] whose underlying connection supports half-close
+// in both directions.
+type halfCloseConn struct{ *Conn }
+
+// CloseWrite shuts down the writing side of the connection once all data
+// written before it has been delivered.
+func (c *halfCloseConn) CloseWrite() error { return c.closeWrite() }
+
+// CloseRead shuts down the reading side of the underlying connection.
+func (c *halfCloseConn) CloseRead() error { return c.Conn.Conn.(closeReader).CloseRead() }
+
+// closeWriteConn is a [Conn] whose underlying connection supports CloseWrite
+// only, such as [*tls.Conn].
+type closeWriteConn struct{ *Conn }
+
+// CloseWrite shuts down the writing side of the connection once all data
+// written before it has been delivered.
+func (c *closeWriteConn) CloseWrite() error { return c.closeWrite() }
+
+func (c *Conn) opError(op string, err error) error {
+	return &net.OpError{
+		Op:     op,
+		Net:    c.LocalAddr().Network(),
+		Source: c.LocalAddr(),
+		Addr:   c.RemoteAddr(),
+		Err:    err,
+	}
+}
+
 // Handles writes in strict order.
 func (c *Conn) linkLoop() {
+	defer close(c.doneCh)
+
+	// Create a timer but stop it immediately so it doesn't fire yet.
+	timer := c.clock.NewTimer(0)
+	timer.Stop()
+	defer timer.Stop()
 	for {
+		var req writeReq
 		select {
 		case <-c.stopCh:
 			return
-		case req := <-c.writeCh:
-			// Perform fault injection before writing.
-			if c.p.Fault != nil && c.p.Fault.ShouldClose() {
-				c.Close()
+		case req = <-c.writeCh:
+		case <-c.drainCh:
+			select {
+			case req = <-c.writeCh:
+			default:
+				// Lingering close: all queued data has been delivered.
+				return
+			}
+		}
+		// Perform fault injection before writing.
+		if c.p.Fault != nil && c.p.Fault.ShouldClose() {
+			c.sever(syscall.ECONNRESET)
+			return
+		}
+		// Wait until due time.
+		if !c.sleepUntil(timer, req.due) {
+			return
+		}
+		if req.ticket != nil && !req.timedOut {
+			if !c.awaitLink(timer, &req) {
+				return
 			}
-			// Wait until due time.
-			wait := time.Until(req.due)
-			if wait > 0 {
-				time.Sleep(wait)
+			if !c.sleepUntil(timer, req.due) {
+				return
 			}
+		}
+		if req.timedOut {
+			c.sever(syscall.ETIMEDOUT)
+			return
+		}
+		if c.p.Corrupt != nil {
+			c.p.Corrupt.Corrupt(req.data)
+		}
+		var err error
+		if req.eof {
+			err = c.Conn.(closeWriter).CloseWrite()
+		} else {
 			// Write; and because we pull from the channel we can
 			// assume that our packets must be written in order.
-			c.Conn.Write(req.data)
+			_, err = c.Conn.Write(req.data)
+		}
+		if err != nil {
+			select {
+			case <-c.stopCh:
+				// Failures caused by our own Close are not worth reporting.
+			default:
+				c.storeErr(err)
+			}
+		}
+	}
+}
+
+// sleepUntil waits on timer until time t. It returns false if the link loop
+// was stopped in the meantime.
+func (c *Conn) sleepUntil(timer Timer, t time.Time) bool {
+	wait := t.Sub(c.clock.Now())
+	if wait <= 0 {
+		return true
+	}
+	timer.Reset(wait)
+	select {
+	case <-c.stopCh:
+		return false
+	case <-timer.C():
+		return true
+	}
+}
+
+// awaitLink waits until the scheduled Link has forwarded the segment of req,
+// then sends it through the rest of the route. It sets the time the segment
+// arrives at the peer and whether the connection timed out retransmitting
+// it, and returns false if the link loop was stopped in the meantime.
+//
+// The outcome is fed back into the congestion window, so that losses and
+// queueing at the Link slow the sender down.
+func (c *Conn) awaitLink(timer Timer, req *writeReq) bool {
+	p := req.ticket
+	for {
+		t, done := c.flow.link.resolve(p, c.clock.Now())
+		if done {
+			break
 		}
+		if !c.sleepUntil(timer, t) {
+			return false
+		}
+	}
+	if p.timedOut {
+		req.due, req.timedOut = p.exit, true
+		return true
+	}
+	arrival, lost, timedOut := c.p.route[1:].sendReliable(
+		c.clock.Now(), p.exit, p.size, cmp.Or(c.p.MinRTO, defaultMinRTO))
+	req.due, req.timedOut = arrival, timedOut
+	if c.cwnd != nil {
+		lost = lost || req.lost || p.retries > 0
+		c.mu.Lock()
+		c.cwnd.resolved(len(req.data), arrival.Add(req.ackDelay), lost, req.sentAt)
+		close(c.resolved)
+		c.resolved = make(chan struct{})
+		c.mu.Unlock()
+	}
+	return true
+}
+
+// sever closes the connection abruptly, without lingering, and records errno
+// as the error reported by subsequent writes.
+func (c *Conn) sever(errno syscall.Errno) {
+	c.storeErr(c.opError("write", errno))
+	c.stop()
+	c.Conn.Close()
+}
+
+// stop aborts the link loop; it may be called more than once.
+func (c *Conn) stop() {
+	c.stopOnce.Do(func() { close(c.stopCh) })
+}
+
+// storeErr records err if no previous error has been recorded.
+func (c *Conn) storeErr(err error) {
+	c.errMu.Lock()
+	defer c.errMu.Unlock()
+	if c.err == nil {
+		c.err = err
 	}
 }
 
+// loadErr returns the first error encountered by the link loop, if any.
+func (c *Conn) loadErr() error {
+	c.errMu.Lock()
+	defer c.errMu.Unlock()
+	return c.err
+}
+
 func (c *Conn) isWriteDeadline() bool {
 	wdl := c.writeDeadline.Load().(time.Time)
-	return !wdl.IsZero() && wdl.Before(time.Now())
+	return !wdl.IsZero() && wdl.Before(c.clock.Now())
+}
+
+// sendSegment reserves the wire for a segment and returns a request due when
+// it arrives at the peer, including any retransmission stalls, which tells
+// whether the connection timed out retransmitting it. It returns false if the
+// link loop was stopped while waiting for the congestion window.
+//
+// If the connection is attached to a Link with a Scheduler, the segment is
+// submitted to it, and the request is due when it reaches the Link; its
+// ticket then tells when it leaves.
+func (c *Conn) sendSegment(size int) (writeReq, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	finishTime, ok := c.reserveWireLocked(size)
+	for !ok {
+		// The window is full of segments queued in the Link: wait until the
+		// link loop learns when one of them is acknowledged.
+		resolved := c.resolved
+		c.mu.Unlock()
+		select {
+		case <-c.stopCh:
+			c.mu.Lock()
+			return writeReq{}, false
+		case <-resolved:
+		}
+		c.mu.Lock()
+		finishTime, ok = c.reserveWireLocked(size)
+	}
+	delay := delayTime(c.p.Latency, c.p.Jitter)
+	stall, timedOut := c.retransmissionDelay(delay)
+	arrival, lost := finishTime.Add(delay+stall), stall > 0
+	if c.flow != nil {
+		req := writeReq{due: arrival, timedOut: timedOut}
+		req.ticket = c.flow.submit(arrival, size+c.headerSize, cmp.Or(c.p.MinRTO, defaultMinRTO))
+		if c.cwnd != nil {
+			// The queueing delay is not known until the ticket is resolved.
+			c.cwnd.submitted(size)
+			req.sentAt, req.ackDelay, req.lost = finishTime, delay+c.p.route.delay(), lost
+		}
+		return req, true
+	}
+	if c.p.route != nil {
+		// Continue through every hop of the route, sharing their wires.
+		var routeLost, routeTimedOut bool
+		arrival, routeLost, routeTimedOut = c.p.route.sendReliable(
+			c.clock.Now(), arrival, size+c.headerSize, cmp.Or(c.p.MinRTO, defaultMinRTO))
+		lost, timedOut = lost || routeLost, timedOut || routeTimedOut
+		delay += c.p.route.delay()
+	}
+	if c.cwnd != nil {
+		// The acknowledgement takes another one-way delay to come back.
+		c.cwnd.sent(size, arrival.Add(delay), lost, finishTime)
+	}
+	return writeReq{due: arrival, timedOut: timedOut}, true
 }
 
 // reserveWire calculates when a chunk of data will finish serializing on the wire.
@@ -164,8 +623,15 @@ func (c *Conn) isWriteDeadline() bool {
 func (c *Conn) reserveWire(chunkSize int) time.Time {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	finishTime, _ := c.reserveWireLocked(chunkSize)
+	return finishTime
+}
 
-	now := time.Now()
+// reserveWireLocked is like reserveWire, but c.mu must be held. It returns
+// false, without reserving anything, if the congestion window is full of
+// segments whose acknowledgement time is not known yet.
+func (c *Conn) reserveWireLocked(chunkSize int) (time.Time, bool) {
+	now := c.clock.Now()
 	startTime := c.nextWireTime
 
 	// If the wire is idle, we start immediately.
@@ -173,10 +639,17 @@ func (c *Conn) reserveWire(chunkSize int) time.Time {
 	if startTime.Before(now) {
 		startTime = now
 	}
+	// The congestion window may hold the data back further.
+	if c.cwnd != nil && chunkSize > 0 {
+		var ok bool
+		if startTime, ok = c.cwnd.wait(startTime, chunkSize); !ok {
+			return time.Time{}, false
+		}
+	}
 
 	delay := transmissionTime(c.p.Bandwidth, chunkSize, c.headerSize)
 	finishTime := startTime.Add(delay)
 
 	c.nextWireTime = finishTime
-	return finishTime
+	return finishTime, true
 }
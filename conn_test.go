@@ -1,8 +1,12 @@
 package netem_test
 
 import (
+	"bytes"
+	"errors"
 	"io"
 	"net"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
@@ -138,3 +142,385 @@ func TestConn_Dynamic(t *testing.T) {
 		t.Errorf("Expected slow (>200ms) after update, got %v", d)
 	}
 }
+
+// TestConn_Linger verifies that a lingering Close delivers queued data before
+// closing, and reports data it had to discard once the linger timeout expires.
+func TestConn_Linger(t *testing.T) {
+	const latency = 100 * time.Millisecond
+
+	t.Run("Flush", func(t *testing.T) {
+		c1, c2 := net.Pipe()
+		defer c2.Close()
+		emulatedConn := netem.NewConn(c1, netem.StreamProfile{
+			Latency: policy.StaticLatency(latency),
+			Linger:  time.Second,
+		})
+
+		readData := make(chan []byte, 1)
+		go func() {
+			data, _ := io.ReadAll(c2)
+			readData <- data
+		}()
+
+		if _, err := emulatedConn.Write([]byte("goodbye")); err != nil {
+			t.Fatal(err)
+		}
+		start := time.Now()
+		if err := emulatedConn.Close(); err != nil {
+			t.Fatalf("Close failed: %v", err)
+		}
+		if elapsed := time.Since(start); elapsed < latency/2 {
+			t.Errorf("Close returned after %v; expected it to wait for delivery", elapsed)
+		}
+		if data := <-readData; string(data) != "goodbye" {
+			t.Errorf("got %q, want %q", data, "goodbye")
+		}
+	})
+
+	t.Run("Timeout", func(t *testing.T) {
+		c1, c2 := net.Pipe()
+		defer c2.Close()
+		emulatedConn := netem.NewConn(c1, netem.StreamProfile{
+			Latency: policy.StaticLatency(latency),
+			Linger:  10 * time.Millisecond,
+		})
+		go io.Copy(io.Discard, c2)
+
+		if _, err := emulatedConn.Write([]byte("goodbye")); err != nil {
+			t.Fatal(err)
+		}
+		if err := emulatedConn.Close(); !errors.Is(err, netem.ErrDataDiscarded) {
+			t.Errorf("Close returned %v, want %v", err, netem.ErrDataDiscarded)
+		}
+	})
+}
+
+// newTCPPair returns both ends of a loopback TCP connection.
+func newTCPPair(t *testing.T) (client, server net.Conn) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, _ := l.Accept()
+		accepted <- c
+	}()
+	client, err = net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	server = <-accepted
+	if server == nil {
+		t.Fatal("failed to accept")
+	}
+	return client, server
+}
+
+// TestConn_CloseWrite verifies that a half-close is delivered after the data
+// written before it, and is only exposed if the wrapped connection supports it.
+func TestConn_CloseWrite(t *testing.T) {
+	client, server := newTCPPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	const latency = 50 * time.Millisecond
+	emulatedConn := netem.NewConn(client, netem.StreamProfile{
+		Latency: policy.StaticLatency(latency),
+	})
+	defer emulatedConn.Close()
+
+	cw, ok := emulatedConn.(interface{ CloseWrite() error })
+	if !ok {
+		t.Fatal("wrapped *net.TCPConn does not implement CloseWrite")
+	}
+
+	start := time.Now()
+	if _, err := emulatedConn.Write([]byte("request")); err != nil {
+		t.Fatal(err)
+	}
+	if err := cw.CloseWrite(); err != nil {
+		t.Fatalf("CloseWrite failed: %v", err)
+	}
+	if _, err := emulatedConn.Write([]byte("more")); err == nil {
+		t.Error("Write after CloseWrite succeeded")
+	}
+
+	// ReadAll returns once the peer observes EOF.
+	data, err := io.ReadAll(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "request" {
+		t.Errorf("got %q, want %q", data, "request")
+	}
+	if elapsed := time.Since(start); elapsed < latency {
+		t.Errorf("EOF arrived too fast! Expected >%v, got %v", latency, elapsed)
+	}
+
+	// net.Pipe does not support half-close, so neither should its wrapper.
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	if _, ok := netem.NewConn(c1, netem.StreamProfile{}).(interface{ CloseWrite() error }); ok {
+		t.Error("wrapped net.Pipe implements CloseWrite")
+	}
+}
+
+// TestConn_AsyncError verifies that a failure to deliver queued data is
+// reported by subsequent writes.
+func TestConn_AsyncError(t *testing.T) {
+	c1, c2 := net.Pipe()
+	emulatedConn := netem.NewConn(c1, netem.StreamProfile{
+		Latency: policy.StaticLatency(10 * time.Millisecond),
+	})
+
+	// The peer goes away; the write is accepted because delivery is deferred.
+	c2.Close()
+	if _, err := emulatedConn.Write([]byte("lost")); err != nil {
+		t.Fatalf("first Write failed: %v", err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		_, err := emulatedConn.Write([]byte("x"))
+		if errors.Is(err, io.ErrClosedPipe) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Write returned %v, want %v", err, io.ErrClosedPipe)
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("delivery error was never reported by Write")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := emulatedConn.Close(); !errors.Is(err, io.ErrClosedPipe) {
+		t.Errorf("Close returned %v, want %v", err, io.ErrClosedPipe)
+	}
+}
+
+// TestConn_CloseAfterReset verifies that Close reports why the connection
+// was severed, even though the underlying socket is already closed.
+func TestConn_CloseAfterReset(t *testing.T) {
+	client, server := newTCPPair(t)
+	defer server.Close()
+	emulatedConn := netem.NewConn(client, netem.StreamProfile{
+		Fault: policy.FaultFunc(func() bool { return true }),
+	})
+
+	if _, err := emulatedConn.Write([]byte("x")); err != nil {
+		t.Fatalf("first Write failed: %v", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		_, err := emulatedConn.Write([]byte("x"))
+		if errors.Is(err, syscall.ECONNRESET) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Write returned %v, want %v", err, syscall.ECONNRESET)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := emulatedConn.Close(); !errors.Is(err, syscall.ECONNRESET) {
+		t.Errorf("Close returned %v, want %v", err, syscall.ECONNRESET)
+	}
+}
+
+// TestConn_Corrupt verifies that the corruption policy is applied to stream
+// data before delivery.
+func TestConn_Corrupt(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	emulatedConn := netem.NewConn(c1, netem.StreamProfile{
+		Corrupt: policy.CorruptOffset(-1, 0x20),
+	})
+	go emulatedConn.Write([]byte("checksum"))
+
+	buf := make([]byte, 8)
+	if _, err := io.ReadFull(c2, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "checksuM" {
+		t.Errorf("got %q, want %q", buf, "checksuM")
+	}
+}
+
+// TestConn_Loss verifies that a lost segment is delivered after a
+// retransmission timeout, and holds back the segments behind it.
+func TestConn_Loss(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	// Lose the first segment once.
+	var lost atomic.Bool
+	const latency = 10 * time.Millisecond
+	const minRTO = 100 * time.Millisecond
+	emulatedConn := netem.NewConn(c1, netem.StreamProfile{
+		Latency: policy.StaticLatency(latency),
+		Loss:    policy.LossFunc(func() bool { return !lost.Swap(true) }),
+		MinRTO:  minRTO,
+	})
+
+	start := time.Now()
+	go func() {
+		emulatedConn.Write([]byte("a"))
+		emulatedConn.Write([]byte("b"))
+	}()
+
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(c2, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "ab" {
+		t.Errorf("Stream corrupted! Expected 'ab', got '%s'", buf)
+	}
+	// RTO = RTT + MinRTO, on top of the one-way latency.
+	if want := 3*latency + minRTO; time.Since(start) < want {
+		t.Errorf("Too fast! Expected >%v, got %v", want, time.Since(start))
+	}
+}
+
+// TestConn_Congestion verifies that the congestion window holds back data
+// beyond the initial window until the first acknowledgements return.
+func TestConn_Congestion(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	const latency = 50 * time.Millisecond
+	emulatedConn := netem.NewConn(c1, netem.StreamProfile{
+		Latency:    policy.StaticLatency(latency),
+		Congestion: netem.Reno{InitialWindow: 2},
+	})
+
+	// Four segments: two fit in the initial window, the other two have to
+	// wait one round trip for their acknowledgements.
+	segment := make([]byte, 1000)
+	start := time.Now()
+	go func() {
+		for range 4 {
+			emulatedConn.Write(segment)
+		}
+	}()
+
+	buf := make([]byte, 2*len(segment))
+	if _, err := io.ReadFull(c2, buf); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*latency {
+		t.Errorf("initial window took %v; expected ~%v", elapsed, latency)
+	}
+	if _, err := io.ReadFull(c2, buf); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 3*latency {
+		t.Errorf("Too fast! Expected second window after >%v, got %v", 3*latency, elapsed)
+	}
+}
+
+// TestConn_Segments verifies that a large write is delivered intact, one
+// MSS-sized segment at a time.
+func TestConn_Segments(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	const mtu = 576
+	const mss = mtu - netem.IPv6HeaderSize // net.Pipe addresses are not IPv4
+	emulatedConn := netem.NewConn(c1, netem.StreamProfile{
+		MTU:       mtu,
+		Bandwidth: policy.StaticBandwidth(1_000_000), // ~4.6ms per segment
+	})
+
+	data := make([]byte, 3*mss+100)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	go emulatedConn.Write(data)
+
+	var got []byte
+	buf := make([]byte, len(data))
+	for len(got) < len(data) {
+		n, err := c2.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n > mss {
+			t.Errorf("Read returned %d bytes; want at most one %d-byte segment", n, mss)
+		}
+		got = append(got, buf[:n]...)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("Stream corrupted! Data does not match what was written")
+	}
+}
+
+// TestConn_ShortRead verifies that reads are split at the configured stream
+// offsets even when more data is available.
+func TestConn_ShortRead(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	emulatedConn := netem.NewConn(c1, netem.StreamProfile{
+		ShortRead: policy.SplitReads(3, 4),
+	})
+	go c2.Write([]byte("hello"))
+
+	buf := make([]byte, 16)
+	for _, want := range []string{"hel", "l", "o"} {
+		n, err := emulatedConn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != want {
+			t.Errorf("Read returned %q, want %q", buf[:n], want)
+		}
+	}
+}
+
+// TestConn_FakeClock verifies that data is scheduled on the profile's clock,
+// so that a long latency takes no real time.
+func TestConn_FakeClock(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	clock := netem.NewFakeClock(time.Now())
+	emulatedConn := netem.NewConn(c1, netem.StreamProfile{
+		Latency: policy.StaticLatency(time.Hour),
+		Clock:   clock,
+	})
+	if _, err := emulatedConn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+
+	arrived := make(chan struct{})
+	go func() {
+		buf := make([]byte, 4)
+		_, _ = io.ReadFull(c2, buf)
+		close(arrived)
+	}()
+
+	clock.BlockUntil(1)
+	clock.Advance(time.Hour - time.Second)
+	select {
+	case <-arrived:
+		t.Fatal("data arrived before the latency elapsed")
+	case <-time.After(50 * time.Millisecond):
+	}
+	clock.Advance(time.Second)
+	select {
+	case <-arrived:
+	case <-time.After(2 * time.Second):
+		t.Fatal("data did not arrive once the latency elapsed")
+	}
+}
@@ -0,0 +1,111 @@
+package netem
+
+import (
+	"net"
+	"net/netip"
+	"slices"
+)
+
+// DestinationProfiles selects the [PacketProfile] of the path to each
+// destination of a connection created by [NewPacketConnPerDestination].
+//
+// A destination is matched, in order of precedence, by its exact address, by
+// its IP address, by the longest matching prefix, and finally by the
+// functions in the order they were added. Destinations that match no rule use
+// the Default profile.
+//
+// Rules must not be added once the DestinationProfiles is in use.
+type DestinationProfiles struct {
+	// Default is the profile of destinations that match no rule.
+	Default PacketProfile
+
+	addrs    map[string]PacketProfile
+	ips      map[netip.Addr]PacketProfile
+	prefixes []prefixProfile // sorted by descending prefix length
+	funcs    []func(net.Addr) (PacketProfile, bool)
+}
+
+type prefixProfile struct {
+	prefix netip.Prefix
+	p      PacketProfile
+}
+
+// AddAddr uses p for the destination addr, matched by its string form
+// (e.g. "192.0.2.1:53").
+func (d *DestinationProfiles) AddAddr(addr net.Addr, p PacketProfile) {
+	if d.addrs == nil {
+		d.addrs = make(map[string]PacketProfile)
+	}
+	d.addrs[addr.String()] = p
+}
+
+// AddIP uses p for every destination with the given IP address, on any port.
+func (d *DestinationProfiles) AddIP(ip netip.Addr, p PacketProfile) {
+	if d.ips == nil {
+		d.ips = make(map[netip.Addr]PacketProfile)
+	}
+	d.ips[ip.Unmap()] = p
+}
+
+// AddPrefix uses p for every destination within prefix, such as a CIDR block.
+func (d *DestinationProfiles) AddPrefix(prefix netip.Prefix, p PacketProfile) {
+	prefix = prefix.Masked()
+	i, _ := slices.BinarySearchFunc(d.prefixes, prefix.Bits(), func(e prefixProfile, bits int) int {
+		return bits - e.prefix.Bits()
+	})
+	d.prefixes = slices.Insert(d.prefixes, i, prefixProfile{prefix: prefix, p: p})
+}
+
+// AddFunc adds a function that selects the profile of a destination. It
+// returns false if it does not apply to the destination.
+func (d *DestinationProfiles) AddFunc(fn func(addr net.Addr) (PacketProfile, bool)) {
+	d.funcs = append(d.funcs, fn)
+}
+
+// lookup returns the profile of the path to addr.
+func (d *DestinationProfiles) lookup(addr net.Addr) PacketProfile {
+	if addr == nil {
+		return d.Default
+	}
+	if p, ok := d.addrs[addr.String()]; ok {
+		return p
+	}
+	if ip, ok := addrIP(addr); ok {
+		if p, ok := d.ips[ip]; ok {
+			return p
+		}
+		for _, e := range d.prefixes {
+			if e.prefix.Contains(ip) {
+				return e.p
+			}
+		}
+	}
+	for _, fn := range d.funcs {
+		if p, ok := fn(addr); ok {
+			return p
+		}
+	}
+	return d.Default
+}
+
+// addrIP returns the IP address of addr, if it has one.
+func addrIP(addr net.Addr) (netip.Addr, bool) {
+	var ip net.IP
+	switch v := addr.(type) {
+	case *net.UDPAddr:
+		ip = v.IP
+	case *net.TCPAddr:
+		ip = v.IP
+	case *net.IPAddr:
+		ip = v.IP
+	default:
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			host = addr.String()
+		}
+		a, err := netip.ParseAddr(host)
+		return a.Unmap(), err == nil
+	}
+	a, ok := netip.AddrFromSlice(ip)
+	return a.Unmap(), ok
+}
@@ -0,0 +1,195 @@
+package netem
+
+import (
+	"cmp"
+	"context"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// SYN retransmission parameters, matching the Linux defaults.
+const (
+	defaultSYNTimeout = time.Second
+	defaultSYNRetries = 6 // net.ipv4.tcp_syn_retries
+)
+
+// ContextDialer dials connections, like [net.Dialer].
+type ContextDialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// Dialer dials connections that emulate network conditions, and emulates the
+// establishment of stream connections (like TCP): the three-way handshake
+// takes one round trip, the SYN may be lost and retransmitted, and the
+// connection may be refused or time out.
+//
+// Connections on packet-oriented networks (like "udp") have no handshake;
+// they are wrapped with [NewPacketConn] and returned right away.
+//
+// Its DialContext method can be used as the DialContext of an
+// [net/http.Transport], or wherever a [ContextDialer] is accepted.
+type Dialer struct {
+	// Dialer dials the wrapped connections.
+	//
+	// Defaults to a zero [net.Dialer] if nil.
+	Dialer ContextDialer
+
+	// Stream is the profile of stream connections, which also determines the
+	// handshake round trip: twice the one-way Latency and Jitter.
+	Stream StreamProfile
+
+	// Packet is the profile of packet connections.
+	Packet PacketProfile
+
+	// SYNLoss emulates the loss of connection requests. A lost SYN is
+	// retransmitted after SYNTimeout, which doubles with every retransmission,
+	// until SYNRetries retransmissions were lost and the dial times out.
+	SYNLoss Loss
+
+	// SYNTimeout is the initial SYN retransmission timeout.
+	//
+	// Defaults to 1s if 0.
+	SYNTimeout time.Duration
+
+	// SYNRetries is the number of SYN retransmissions before giving up.
+	//
+	// Defaults to 6 if 0, for a timeout of 127s.
+	SYNRetries int
+
+	// Refuse reports whether a connection to address should be refused. The
+	// dial then fails with ECONNREFUSED after one round trip, as if the peer
+	// had replied with a reset.
+	Refuse func(network, address string) bool
+
+	// Blackhole reports whether every SYN to address should be lost, so that
+	// the dial times out, as with a firewall that silently drops packets.
+	Blackhole func(network, address string) bool
+}
+
+// Dial connects to the address on the named network, like [net.Dial].
+func (d *Dialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialContext connects to the address on the named network using the
+// provided context, like [net.Dialer.DialContext].
+//
+// The emulated handshake takes place before the wrapped connection is
+// dialed, so that an emulated refusal or timeout does not reach the peer.
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	packet := isPacketNetwork(network)
+	if !packet {
+		if err := d.handshake(ctx, network, address); err != nil {
+			addr := dialAddr{network, address}
+			return nil, &net.OpError{Op: "dial", Net: network, Addr: addr, Err: err}
+		}
+	}
+
+	var dialer ContextDialer = d.Dialer
+	if dialer == nil {
+		dialer = &net.Dialer{}
+	}
+	c, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	if !packet {
+		return NewConn(c, d.Stream), nil
+	}
+	pc, ok := c.(net.PacketConn)
+	if !ok {
+		// Not a datagram socket after all; emulate it as a stream.
+		return NewConn(c, d.Stream), nil
+	}
+	wrapped := NewPacketConn(pc, d.Packet)
+	if uc, ok := wrapped.(*UDPConn); ok {
+		return uc, nil
+	}
+	return &connectedPacketConn{PacketConn: wrapped.(*PacketConn), c: c}, nil
+}
+
+// handshake waits for the emulated connection establishment to complete.
+func (d *Dialer) handshake(ctx context.Context, network, address string) error {
+	clock := clockOrDefault(d.Stream.Clock)
+	links := d.Stream.links()
+	blackhole := d.Blackhole != nil && d.Blackhole(network, address)
+	rto := cmp.Or(d.SYNTimeout, defaultSYNTimeout)
+	retries := cmp.Or(d.SYNRetries, defaultSYNRetries)
+	for i := 0; ; i++ {
+		lost := blackhole || (d.SYNLoss != nil && d.SYNLoss.Drop()) || links.drop()
+		if !lost {
+			break
+		}
+		if err := sleepContext(ctx, clock, rto); err != nil {
+			return err
+		}
+		if i == retries {
+			return os.NewSyscallError("connect", syscall.ETIMEDOUT)
+		}
+		rto = min(2*rto, maxRTO)
+	}
+
+	// SYN, then SYN-ACK (or RST).
+	rtt := 2 * links.delay()
+	for range 2 {
+		rtt += delayTime(d.Stream.Latency, d.Stream.Jitter)
+	}
+	if err := sleepContext(ctx, clock, rtt); err != nil {
+		return err
+	}
+	if d.Refuse != nil && d.Refuse(network, address) {
+		return os.NewSyscallError("connect", syscall.ECONNREFUSED)
+	}
+	return nil
+}
+
+// sleepContext waits for duration d on clock, or until ctx is done.
+func sleepContext(ctx context.Context, clock Clock, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := clock.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C():
+		return nil
+	}
+}
+
+// isPacketNetwork reports whether network is packet-oriented.
+func isPacketNetwork(network string) bool {
+	switch network {
+	case "udp", "udp4", "udp6", "unixgram":
+		return true
+	}
+	return strings.HasPrefix(network, "ip")
+}
+
+// dialAddr is the address of a failed dial.
+type dialAddr struct{ network, address string }
+
+func (a dialAddr) Network() string { return a.network }
+func (a dialAddr) String() string  { return a.address }
+
+// connectedPacketConn is a connected [PacketConn], other than UDP, returned by
+// [Dialer].
+type connectedPacketConn struct {
+	*PacketConn
+	c net.Conn
+}
+
+func (c *connectedPacketConn) Read(b []byte) (int, error) { return c.c.Read(b) }
+
+func (c *connectedPacketConn) Write(b []byte) (int, error) {
+	n, _, err := c.writeMsg(b, nil, nil)
+	return n, err
+}
+
+func (c *connectedPacketConn) RemoteAddr() net.Addr { return c.c.RemoteAddr() }
+
+var _ ContextDialer = (*Dialer)(nil)
@@ -0,0 +1,126 @@
+package netem_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+	"testing/synctest"
+	"time"
+
+	"github.com/kasader/netem"
+	"github.com/kasader/netem/policy"
+)
+
+// pipeDialer dials in-memory connections, which are durably blocking inside
+// a synctest bubble.
+type pipeDialer struct{}
+
+func (pipeDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	c1, c2 := net.Pipe()
+	c2.Close()
+	return c1, nil
+}
+
+// TestDialer_Handshake verifies that a dial takes one round trip, plus the
+// backoff of every lost SYN.
+func TestDialer_Handshake(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		const latency = 50 * time.Millisecond
+		lost := 2
+		d := &netem.Dialer{
+			Dialer: pipeDialer{},
+			Stream: netem.StreamProfile{Latency: policy.StaticLatency(latency)},
+			SYNLoss: policy.LossFunc(func() bool {
+				lost--
+				return lost >= 0
+			}),
+		}
+
+		start := time.Now()
+		c, err := d.Dial("tcp", "example.com:80")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		// SYNs lost at 0s and 1s, then answered after 3s.
+		if elapsed, want := time.Since(start), 3*time.Second+2*latency; elapsed != want {
+			t.Errorf("dial took %v, want exactly %v", elapsed, want)
+		}
+	})
+}
+
+// TestDialer_Errors verifies emulated connection refusals and timeouts.
+func TestDialer_Errors(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		d := &netem.Dialer{
+			Dialer:    pipeDialer{},
+			Refuse:    func(network, address string) bool { return address == "refused:1" },
+			Blackhole: func(network, address string) bool { return address == "blackhole:1" },
+		}
+
+		if _, err := d.Dial("tcp", "refused:1"); !errors.Is(err, syscall.ECONNREFUSED) {
+			t.Errorf("dial returned %v, want %v", err, syscall.ECONNREFUSED)
+		}
+
+		start := time.Now()
+		if _, err := d.Dial("tcp", "blackhole:1"); !errors.Is(err, syscall.ETIMEDOUT) {
+			t.Errorf("dial returned %v, want %v", err, syscall.ETIMEDOUT)
+		}
+		if elapsed, want := time.Since(start), 127*time.Second; elapsed != want {
+			t.Errorf("dial timed out after %v, want exactly %v", elapsed, want)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		_, err := d.DialContext(ctx, "tcp", "blackhole:1")
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("dial returned %v, want %v", err, context.DeadlineExceeded)
+		}
+	})
+}
+
+// TestDialer_UDP verifies that a dialed UDP connection is wrapped with the
+// packet profile and can be used as a connected net.Conn.
+func TestDialer_UDP(t *testing.T) {
+	receiver := newLocalListener(t)
+	defer receiver.Close()
+
+	const latency = 100 * time.Millisecond
+	d := &netem.Dialer{
+		Packet: netem.PacketProfile{Latency: policy.StaticLatency(latency)},
+	}
+	start := time.Now()
+	c, err := d.Dial("udp", receiver.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, ok := c.(*netem.UDPConn); !ok {
+		t.Errorf("Dial returned %T, want *netem.UDPConn", c)
+	}
+	if _, err := c.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 16)
+	_ = receiver.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, addr, err := receiver.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("ReadFrom failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < latency {
+		t.Errorf("Too fast! Expected >%v, got %v", latency, elapsed)
+	}
+	if string(buf[:n]) != "ping" {
+		t.Errorf("got %q, want %q", buf[:n], "ping")
+	}
+	if _, err := receiver.WriteTo([]byte("pong"), addr); err != nil {
+		t.Fatal(err)
+	}
+	_ = c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if n, err := c.Read(buf); err != nil || string(buf[:n]) != "pong" {
+		t.Errorf("Read returned %q, %v; want %q", buf[:n], err, "pong")
+	}
+}
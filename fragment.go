@@ -0,0 +1,104 @@
+package netem
+
+import (
+	"cmp"
+	"net"
+	"time"
+)
+
+// defaultReassemblyTimeout matches the Linux default (net.ipv4.ipfrag_time).
+const defaultReassemblyTimeout = 30 * time.Second
+
+// fragGroup tracks the reassembly of a datagram sent as IP fragments. It is
+// only accessed by the link loop.
+type fragGroup struct {
+	req     packetReq // the whole datagram
+	arrived []bool
+	pending int
+	timeout time.Duration
+	first   time.Time // arrival of the first fragment
+	failed  bool
+}
+
+// arrive records the arrival (or loss) of a copy of fragment i at time now.
+// Once the last missing fragment arrives, it returns the reassembled datagram.
+//
+// A lost copy does not count as arrived, but a duplicate of it may still
+// arrive. The reassembly timeout is only checked when a fragment arrives: a
+// datagram with a fragment that never arrives is never delivered anyway, and
+// its group is released along with its last fragment.
+func (g *fragGroup) arrive(i int, lost bool, now time.Time) (packetReq, bool) {
+	if lost || g.failed || g.arrived[i] {
+		// Lost, already given up, or a duplicated fragment.
+		return packetReq{}, false
+	}
+	if g.first.IsZero() {
+		g.first = now
+	}
+	if now.Sub(g.first) > g.timeout {
+		// A fragment missing for too long dooms the whole datagram.
+		g.failed = true
+		return packetReq{}, false
+	}
+	g.arrived[i] = true
+	g.pending--
+	return g.req, g.pending == 0
+}
+
+// writeFragments queues a datagram that exceeds the MTU as a series of IP
+// fragments, each of which carries at most the MTU worth of bytes.
+func (c *PacketConn) writeFragments(
+	path *packetPath,
+	p, oob []byte,
+	addr net.Addr,
+) (n, oobn int, err error) {
+	sizes := fragmentSizes(len(p)+getTransportHeaderSize(c.LocalAddr()), path.mtu, c.headerSize)
+	now := c.clock.Now()
+	g := &fragGroup{
+		req: packetReq{
+			data: make([]byte, len(p)),
+			addr: addr,
+			sent: now,
+			path: path,
+		},
+		arrived: make([]bool, len(sizes)),
+		pending: len(sizes),
+		timeout: cmp.Or(path.p.ReassemblyTimeout, defaultReassemblyTimeout),
+	}
+	copy(g.req.data, p)
+	if oob != nil {
+		g.req.oob = make([]byte, len(oob))
+		copy(g.req.oob, oob)
+	}
+
+	for i, size := range sizes {
+		req := packetReq{
+			addr:      addr,
+			size:      size,
+			sent:      now,
+			path:      path,
+			frag:      g,
+			fragIndex: i,
+		}
+		select {
+		case <-c.stopCh:
+			return c.writeOut(g.req)
+		case c.writeCh <- req:
+		}
+	}
+	return len(p), len(oob), nil
+}
+
+// fragmentSizes returns the on-wire size of each IP fragment needed to carry
+// an IP payload of the given size. The payload of every fragment but the last
+// is a multiple of 8 bytes, as required by the fragment offset field.
+func fragmentSizes(payload, mtu, headerSize int) []int {
+	per := max(8, (mtu-headerSize)&^7)
+	sizes := make([]int, 0, (payload+per-1)/per)
+	for payload > 0 {
+		n := min(payload, per)
+		sizes = append(sizes, n+headerSize)
+		payload -= n
+	}
+	return sizes
+}
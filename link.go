@@ -0,0 +1,226 @@
+package netem
+
+import (
+	"cmp"
+	"container/heap"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Link is a physical link, in one direction, that may be shared by many
+// connections. All traffic over it shares one wire, so that the aggregate
+// throughput of every connection attached to it is capped by its Bandwidth,
+// and a connection's data queues behind the data of others.
+//
+// Each datagram or segment reserves the earliest slot of wire time at or
+// after it reaches the link, then propagates for the link's Latency and
+// Jitter, and may be lost. If the profile has a [Scheduler], packets instead
+// wait in a queue per connection until the scheduler picks them, so that
+// later packets may overtake earlier ones.
+//
+// To attach a connection, set the Link of its [StreamProfile] or
+// [PacketProfile]. A Link is safe for concurrent use.
+type Link struct {
+	p   LinkProfile
+	mtu uint
+
+	mu   sync.Mutex
+	busy []interval // reserved wire time, sorted and disjoint
+
+	// With a Scheduler, the wire is instead simulated packet by packet.
+	sched    scheduler
+	pending  linkPacketHeap // submitted packets, not yet queued
+	wireFree time.Time      // when the wire finishes the current packet
+	seq      uint64
+}
+
+// interval is a reservation of the wire.
+type interval struct{ start, end time.Time }
+
+// NewLink returns a new Link with the profile p.
+func NewLink(p LinkProfile) *Link {
+	l := &Link{p: p, mtu: cmp.Or(p.MTU, EthernetDefaultMTU)}
+	if p.Scheduler != nil {
+		l.sched = p.Scheduler.newScheduler()
+	}
+	return l
+}
+
+// transmit sends a packet of size bytes (including headers) that reaches the
+// link at time t, and returns the time it reaches the far end, or false if it
+// was lost. now is the current time.
+func (l *Link) transmit(now, t time.Time, size int) (time.Time, bool) {
+	if size > int(l.mtu) {
+		return t, false
+	}
+	l.mu.Lock()
+	finish := l.reserveLocked(now, t, transmissionTime(l.p.Bandwidth, size, 0))
+	l.mu.Unlock()
+	if l.p.Loss != nil && l.p.Loss.Drop() {
+		return finish, false
+	}
+	return finish.Add(delayTime(l.p.Latency, l.p.Jitter)), true
+}
+
+// reserveLocked reserves the wire for d at the earliest time at or after t,
+// and returns the time the reservation ends; l.mu must be held.
+func (l *Link) reserveLocked(now, t time.Time, d time.Duration) time.Time {
+	// Forget reservations that are over.
+	i := 0
+	for i < len(l.busy) && !l.busy[i].end.After(now) {
+		i++
+	}
+	l.busy = l.busy[i:]
+	if d <= 0 {
+		return t
+	}
+
+	start := t
+	i = 0
+	for ; i < len(l.busy); i++ {
+		if !start.Add(d).After(l.busy[i].start) {
+			break // Fits in the gap before this reservation.
+		}
+		start = later(start, l.busy[i].end)
+	}
+	l.busy = slices.Insert(l.busy, i, interval{start, start.Add(d)})
+	return start.Add(d)
+}
+
+// linkFlow is a connection, or a path of a [PacketConn], attached to a Link
+// with a [Scheduler].
+type linkFlow struct {
+	link     *Link
+	weight   int
+	priority int
+}
+
+// linkPacket is a datagram or segment submitted to a Link with a
+// [Scheduler]. Once done, its outcome no longer changes.
+type linkPacket struct {
+	flow    *linkFlow
+	size    int
+	arrival time.Time // when it reaches the link
+	seq     uint64    // submission order, to break ties
+	tag     float64   // virtual finish time, for WFQ
+
+	rto     time.Duration // retransmission timeout, if reliable
+	retries int
+
+	done     bool
+	exit     time.Time // when it reaches the far end (or was lost)
+	lost     bool
+	timedOut bool // retransmissions were exhausted
+}
+
+// attach returns a new flow with the given Weight and Priority of a profile.
+func (l *Link) attach(weight, priority int) *linkFlow {
+	return &linkFlow{link: l, weight: max(weight, 1), priority: priority}
+}
+
+// submit hands a packet of size bytes, reaching the link at time arrival, to
+// the scheduler. If minRTO is positive, the packet is a stream segment that
+// is retransmitted while it is lost. The outcome is known once resolve
+// reports it done.
+func (f *linkFlow) submit(arrival time.Time, size int, minRTO time.Duration) *linkPacket {
+	l := f.link
+	p := &linkPacket{flow: f, size: size, arrival: arrival}
+	if minRTO > 0 {
+		p.rto = 2*delayTime(l.p.Latency, l.p.Jitter) + minRTO
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	p.seq = l.seq
+	l.seq++
+	heap.Push(&l.pending, p)
+	return p
+}
+
+// resolve runs the scheduler up to time now. If p has been forwarded (or
+// lost), it returns the time p reaches the far end and true; otherwise, it
+// returns the time after which it should be called again, and false.
+func (l *Link) resolve(p *linkPacket, now time.Time) (time.Time, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.advanceLocked(now)
+	if p.done {
+		return p.exit, true
+	}
+	if l.sched.len() > 0 {
+		return l.wireFree, false
+	}
+	return later(l.wireFree, l.pending[0].arrival), false
+}
+
+// advanceLocked makes every scheduling decision due by time now; l.mu must be
+// held. Decisions are only made once no packet submitted later can reach the
+// link before them, as packets are never submitted in the past.
+func (l *Link) advanceLocked(now time.Time) {
+	for {
+		t := l.wireFree
+		if l.sched.len() == 0 {
+			if len(l.pending) == 0 {
+				return
+			}
+			t = later(t, l.pending[0].arrival)
+		}
+		if t.After(now) {
+			return
+		}
+		for len(l.pending) > 0 && !l.pending[0].arrival.After(t) {
+			p := heap.Pop(&l.pending).(*linkPacket)
+			if !l.sched.enqueue(p) {
+				l.loseLocked(p, t) // Tail drop.
+			}
+		}
+		p := l.sched.dequeue()
+		if p == nil {
+			continue
+		}
+		l.wireFree = t.Add(transmissionTime(l.p.Bandwidth, p.size, 0))
+		if l.p.Loss != nil && l.p.Loss.Drop() {
+			l.loseLocked(p, l.wireFree)
+			continue
+		}
+		p.done, p.exit = true, l.wireFree.Add(delayTime(l.p.Latency, l.p.Jitter))
+	}
+}
+
+// loseLocked records the loss of p at time t, and schedules its
+// retransmission if it is reliable; l.mu must be held.
+func (l *Link) loseLocked(p *linkPacket, t time.Time) {
+	if p.rto > 0 && p.retries < maxRetransmits {
+		p.retries++
+		p.arrival = t.Add(p.rto)
+		p.rto = min(2*p.rto, maxRTO)
+		heap.Push(&l.pending, p)
+		return
+	}
+	p.done, p.exit, p.lost = true, t, true
+	p.timedOut = p.rto > 0
+}
+
+// linkPacketHeap is a Min-Heap of packets sorted by arrival time.
+type linkPacketHeap []*linkPacket
+
+func (h linkPacketHeap) Len() int { return len(h) }
+func (h linkPacketHeap) Less(i, j int) bool {
+	if h[i].arrival.Equal(h[j].arrival) {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].arrival.Before(h[j].arrival)
+}
+func (h linkPacketHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *linkPacketHeap) Push(x any) {
+	*h = append(*h, x.(*linkPacket))
+}
+
+func (h *linkPacketHeap) Pop() any {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[0 : n-1]
+	return x
+}
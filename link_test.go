@@ -0,0 +1,277 @@
+package netem_test
+
+import (
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"testing/synctest"
+	"time"
+
+	"github.com/kasader/netem"
+	"github.com/kasader/netem/policy"
+)
+
+// TestLink_SharedBandwidth verifies that connections attached to the same
+// Link share its bandwidth, whether they are streams or datagram sockets.
+func TestLink_SharedBandwidth(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		link := netem.NewLink(netem.LinkProfile{
+			Bandwidth: policy.StaticBandwidth(80_000), // 100ms per 1000 bytes
+		})
+
+		c1, c2 := net.Pipe()
+		defer c2.Close()
+		stream := netem.NewConn(c1, netem.StreamProfile{Link: link})
+		defer stream.Close()
+
+		a, b := newMemPacketPair()
+		defer b.Close()
+		packets := netem.NewPacketConn(a, netem.PacketProfile{Link: link})
+		defer packets.Close()
+
+		start := time.Now()
+		// net.Pipe addresses are not IP, so an IPv6 header is assumed.
+		if _, err := stream.Write(make([]byte, 1000-netem.IPv6HeaderSize)); err != nil {
+			t.Fatal(err)
+		}
+		datagram := make([]byte, 1000-netem.IPv4HeaderSize)
+		for range 2 {
+			if _, err := packets.WriteTo(datagram, b.LocalAddr()); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		done := make(chan time.Duration)
+		go func() {
+			io.ReadFull(c2, make([]byte, 1000-netem.IPv6HeaderSize))
+			done <- time.Since(start)
+		}()
+		var last time.Duration
+		buf := make([]byte, 1000)
+		for range 2 {
+			if _, _, err := b.ReadFrom(buf); err != nil {
+				t.Fatal(err)
+			}
+			last = max(last, time.Since(start))
+		}
+		last = max(last, <-done)
+		if want := 300 * time.Millisecond; last != want {
+			t.Errorf("last data arrived after %v, want exactly %v", last, want)
+		}
+	})
+}
+
+// TestLink_StrictPriority verifies that an interactive flow with a higher
+// priority overtakes bulk data queued in a shared Link.
+func TestLink_StrictPriority(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		sched netem.Scheduler
+		want  time.Duration
+	}{
+		{"FIFO", netem.FIFO{}, 1100 * time.Millisecond},
+		{"StrictPriority", netem.StrictPriority{}, 200 * time.Millisecond},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			synctest.Test(t, func(t *testing.T) {
+				link := netem.NewLink(netem.LinkProfile{
+					Bandwidth: policy.StaticBandwidth(80_000), // 100ms per 1000 bytes
+					Scheduler: tt.sched,
+				})
+
+				c1, c2 := net.Pipe()
+				defer c2.Close()
+				go io.Copy(io.Discard, c2)
+				bulk := netem.NewConn(c1, netem.StreamProfile{MTU: 1000, Link: link, Priority: 1})
+				defer bulk.Close()
+
+				a, b := newMemPacketPair()
+				defer b.Close()
+				interactive := netem.NewPacketConn(a, netem.PacketProfile{Link: link})
+				defer interactive.Close()
+
+				// Ten full segments, then a datagram while the first is on the wire.
+				start := time.Now()
+				if _, err := bulk.Write(make([]byte, 10*(1000-netem.IPv6HeaderSize))); err != nil {
+					t.Fatal(err)
+				}
+				time.Sleep(time.Millisecond)
+				datagram := make([]byte, 1000-netem.IPv4HeaderSize)
+				if _, err := interactive.WriteTo(datagram, b.LocalAddr()); err != nil {
+					t.Fatal(err)
+				}
+				if _, _, err := b.ReadFrom(make([]byte, 1000)); err != nil {
+					t.Fatal(err)
+				}
+				if got := time.Since(start); got != tt.want {
+					t.Errorf("datagram arrived after %v, want exactly %v", got, tt.want)
+				}
+			})
+		})
+	}
+}
+
+// TestLink_Weights verifies that fair schedulers split the bandwidth of a
+// Link between backlogged flows in proportion to their weights.
+func TestLink_Weights(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		sched netem.Scheduler
+	}{
+		{"DRR", netem.DRR{}},
+		{"WFQ", netem.WFQ{}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			synctest.Test(t, func(t *testing.T) {
+				link := netem.NewLink(netem.LinkProfile{
+					Bandwidth: policy.StaticBandwidth(80_000), // 100ms per 1000 bytes
+					Scheduler: tt.sched,
+				})
+
+				const count = 30
+				arrivals := make([][]time.Duration, 2)
+				datagram := make([]byte, 1000-netem.IPv4HeaderSize)
+				start := time.Now()
+				for i, weight := range []int{2, 1} {
+					a, b := newMemPacketPair()
+					defer b.Close()
+					pc := netem.NewPacketConn(a, netem.PacketProfile{Link: link, Weight: weight})
+					defer pc.Close()
+					for range count {
+						if _, err := pc.WriteTo(datagram, b.LocalAddr()); err != nil {
+							t.Fatal(err)
+						}
+					}
+					go func() {
+						for range count {
+							if _, _, err := b.ReadFrom(make([]byte, 1000)); err != nil {
+								return
+							}
+							arrivals[i] = append(arrivals[i], time.Since(start))
+						}
+					}()
+				}
+				time.Sleep(time.Duration(2*count) * 100 * time.Millisecond)
+				synctest.Wait()
+
+				// By the time the heavier flow is done, the other one should
+				// have sent half as much.
+				if len(arrivals[0]) != count {
+					t.Fatalf("weight 2: %d datagrams arrived, want %d", len(arrivals[0]), count)
+				}
+				finish := arrivals[0][count-1]
+				light := 0
+				for _, at := range arrivals[1] {
+					if at <= finish {
+						light++
+					}
+				}
+				if light < count/2-3 || light > count/2+3 {
+					t.Errorf("weight 1: %d datagrams arrived alongside %d of weight 2, "+
+						"want about %d", light, count, count/2)
+				}
+			})
+		})
+	}
+}
+
+// TestLink_Duplicate verifies that a duplicated datagram crosses the Link on
+// its own, after its own DuplicateDelay.
+func TestLink_Duplicate(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		link := netem.NewLink(netem.LinkProfile{
+			Latency: policy.StaticLatency(10 * time.Millisecond),
+		})
+		a, b := newMemPacketPair()
+		defer b.Close()
+		pc := netem.NewPacketConn(a, netem.PacketProfile{
+			Duplicate:      policy.DuplicateFunc(func() bool { return true }),
+			DuplicateDelay: policy.StaticLatency(5 * time.Millisecond),
+			Link:           link,
+		})
+		defer pc.Close()
+
+		start := time.Now()
+		if _, err := pc.WriteTo([]byte("twice"), b.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+		for _, want := range []time.Duration{10 * time.Millisecond, 15 * time.Millisecond} {
+			if _, _, err := b.ReadFrom(make([]byte, 10)); err != nil {
+				t.Fatal(err)
+			}
+			if elapsed := time.Since(start); elapsed != want {
+				t.Errorf("datagram arrived after %v, want exactly %v", elapsed, want)
+			}
+		}
+	})
+}
+
+// TestLink_Dialer verifies that the handshake of a Dialer crosses the Link of
+// its stream profile.
+func TestLink_Dialer(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		const latency = 30 * time.Millisecond
+		link := netem.NewLink(netem.LinkProfile{Latency: policy.StaticLatency(latency)})
+		d := &netem.Dialer{
+			Dialer: pipeDialer{},
+			Stream: netem.StreamProfile{Link: link},
+		}
+
+		start := time.Now()
+		c, err := d.Dial("tcp", "example.com:80")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		if elapsed, want := time.Since(start), 2*latency; elapsed != want {
+			t.Errorf("dial took %v, want exactly %v", elapsed, want)
+		}
+	})
+}
+
+// TestLink_Congestion verifies that the congestion window of connections
+// sharing a Link backs off when their segments are dropped at its queue,
+// rather than retransmitting until the connections time out.
+func TestLink_Congestion(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		link := netem.NewLink(netem.LinkProfile{
+			Bandwidth: policy.StaticBandwidth(1_000_000),
+			Latency:   policy.StaticLatency(5 * time.Millisecond),
+			Scheduler: netem.FIFO{Limit: 3},
+		})
+
+		const size = 50_000
+		start := time.Now()
+		var wg sync.WaitGroup
+		for range 2 {
+			c1, c2 := net.Pipe()
+			conn := netem.NewConn(c1, netem.StreamProfile{
+				Link:       link,
+				Congestion: netem.CUBIC{},
+				Linger:     -1,
+			})
+			wg.Go(func() {
+				defer c2.Close()
+				if _, err := io.ReadFull(c2, make([]byte, size)); err != nil {
+					t.Error(err)
+				}
+			})
+			wg.Go(func() {
+				if _, err := conn.Write(make([]byte, size)); err != nil {
+					t.Error(err)
+				}
+				if err := conn.Close(); err != nil {
+					t.Error(err)
+				}
+			})
+		}
+		wg.Wait()
+		// 100 KB take 0.8s on the wire. Both initial windows overflow the
+		// queue at once, and their retransmissions collide again after the
+		// same timeout, but the connections recover within seconds.
+		if elapsed, limit := time.Since(start), 30*time.Second; elapsed > limit {
+			t.Errorf("transfers took %v, want at most %v", elapsed, limit)
+		}
+	})
+}
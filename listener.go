@@ -0,0 +1,38 @@
+package netem
+
+import "net"
+
+// Listener wraps an existing [net.Listener] so that every accepted connection
+// emulates network conditions, as if wrapped with [NewConn].
+//
+// Because it is a net.Listener, it can be passed directly to servers such as
+// http.Server.Serve to throttle every client of a server.
+type Listener struct {
+	net.Listener
+	profile func(net.Conn) StreamProfile
+}
+
+// NewListener wraps an existing net.Listener so that every accepted
+// connection uses the profile p.
+func NewListener(l net.Listener, p StreamProfile) net.Listener {
+	return NewListenerFunc(l, func(net.Conn) StreamProfile { return p })
+}
+
+// NewListenerFunc wraps an existing net.Listener like [NewListener], but
+// selects the profile of each accepted connection by calling f with the
+// connection before it is wrapped, for example to emulate a different link
+// depending on its RemoteAddr.
+func NewListenerFunc(l net.Listener, f func(net.Conn) StreamProfile) net.Listener {
+	return &Listener{Listener: l, profile: f}
+}
+
+// Accept implements net.Listener.
+func (l *Listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return NewConn(c, l.profile(c)), nil
+}
+
+var _ net.Listener = (*Listener)(nil)
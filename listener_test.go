@@ -0,0 +1,89 @@
+package netem_test
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/kasader/netem"
+	"github.com/kasader/netem/policy"
+)
+
+// TestListener_HTTP verifies that a wrapped listener throttles the responses
+// of an http.Server.
+func TestListener_HTTP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	const latency = 100 * time.Millisecond
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "pong")
+	})}
+	go srv.Serve(netem.NewListener(l, netem.StreamProfile{
+		Latency: policy.StaticLatency(latency),
+	}))
+	defer srv.Close()
+
+	start := time.Now()
+	resp, err := http.Get("http://" + l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "pong" {
+		t.Errorf("got body %q, want %q", body, "pong")
+	}
+	if elapsed := time.Since(start); elapsed < latency {
+		t.Errorf("Too fast! Expected >%v, got %v", latency, elapsed)
+	}
+}
+
+// TestListenerFunc verifies that the profile of each accepted connection is
+// selected by the given function.
+func TestListenerFunc(t *testing.T) {
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	l := netem.NewListenerFunc(raw, func(c net.Conn) netem.StreamProfile {
+		if c.RemoteAddr() == nil {
+			t.Error("profile selected without a remote address")
+		}
+		return netem.StreamProfile{ShortRead: policy.OneByteReads()}
+	})
+	defer l.Close()
+
+	go func() {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		c.Write([]byte("hello"))
+		io.Copy(io.Discard, c)
+	}()
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, ok := c.(*netem.TCPConn); !ok {
+		t.Errorf("Accept returned %T, want *netem.TCPConn", c)
+	}
+	buf := make([]byte, 16)
+	n, err := c.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("Read returned %d bytes, want 1", n)
+	}
+}
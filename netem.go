@@ -2,6 +2,7 @@ package netem
 
 import (
 	"net"
+	"strings"
 	"time"
 )
 
@@ -10,6 +11,8 @@ const (
 	IPv4HeaderSize = 20
 	// IPv6HeaderSize is the fixed size of an IPv6 header in bytes.
 	IPv6HeaderSize = 40
+	// UDPHeaderSize is the size of a UDP header in bytes.
+	UDPHeaderSize = 8
 )
 
 const (
@@ -22,11 +25,51 @@ const (
 	IPMaximumMTU = 65_536
 )
 
-// LinkProfile defines the shared physical properties of a network link.
+// LinkProfile defines the shared physical properties of a network link, such
+// as a [Link] or the links of a [Network].
 type LinkProfile struct {
+	// MTU (Maximum Transmission Unit) is the largest packet size allowed.
+	// This value includes L3/L4 headers.
+	//
+	// Defaults to [EthernetDefaultMTU] if 0.
+	MTU uint
+
 	Latency   Latency
 	Jitter    Jitter
 	Bandwidth Bandwidth
+
+	// Loss emulates packet loss. Lost stream segments are retransmitted, as
+	// described by [StreamProfile].
+	Loss Loss
+
+	// Scheduler selects how a [Link] divides its bandwidth between the
+	// connections attached to it, according to their Weight and Priority.
+	// It does not apply to the links of a [Network].
+	//
+	// If nil, packets are sent in the order they reach the link.
+	Scheduler Scheduler
+}
+
+// streamProfile returns the profile of a stream over the link.
+func (p LinkProfile) streamProfile() StreamProfile {
+	return StreamProfile{
+		MTU:       p.MTU,
+		Latency:   p.Latency,
+		Jitter:    p.Jitter,
+		Bandwidth: p.Bandwidth,
+		Loss:      p.Loss,
+	}
+}
+
+// packetProfile returns the profile of datagrams over the link.
+func (p LinkProfile) packetProfile() PacketProfile {
+	return PacketProfile{
+		MTU:       p.MTU,
+		Latency:   p.Latency,
+		Jitter:    p.Jitter,
+		Bandwidth: p.Bandwidth,
+		Loss:      p.Loss,
+	}
 }
 
 func getHeaderSize(addr net.Addr) int {
@@ -56,6 +99,15 @@ func getHeaderSize(addr net.Addr) int {
 	return overhead
 }
 
+// getTransportHeaderSize returns the size of the datagram transport header
+// used by addr, or 0 if there is none (e.g. Unix domain sockets).
+func getTransportHeaderSize(addr net.Addr) int {
+	if _, ok := addr.(*net.UDPAddr); ok || strings.HasPrefix(addr.Network(), "udp") {
+		return UDPHeaderSize
+	}
+	return 0
+}
+
 func transmissionTime(bandwidth Bandwidth, size, overhead int) time.Duration {
 	if bandwidth == nil {
 		return 0
@@ -0,0 +1,722 @@
+package netem
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Ephemeral port range, matching the IANA recommendation.
+const (
+	minEphemeralPort = 49_152
+	maxEphemeralPort = 65_535
+)
+
+// listenBacklog is the number of connections a listener queues before
+// refusing new ones.
+const listenBacklog = 128
+
+// receiveBuffer is the number of datagrams a packet socket queues before
+// dropping new ones.
+const receiveBuffer = 256
+
+// Errors returned by [Network.AddHost].
+var (
+	ErrInvalidHostAddr = errors.New("netem: invalid host address")
+	ErrHostExists      = errors.New("netem: host already exists")
+)
+
+// Network is an in-memory virtual network of hosts.
+//
+// Connections between hosts never touch the operating system: streams are
+// carried by [net.Pipe] and datagrams by channels, while the link between each
+// pair of hosts is emulated by [Conn] and [PacketConn]. Hosts may also be
+// connected through routers with [Network.Connect], to share links between
+// flows. Traffic between sockets of the same host is not emulated.
+//
+// The zero value is an empty network whose links are ideal. Links must be set
+// before the hosts they connect communicate.
+type Network struct {
+	// Default is the profile of links between hosts without a link set by
+	// SetLink.
+	Default LinkProfile
+
+	mu    sync.Mutex
+	hosts map[netip.Addr]*Host
+	names map[string]*Host
+	links map[hostPair]LinkProfile
+	hops  map[hostPair]*Link // physical links of the topology
+}
+
+type hostPair struct{ from, to netip.Addr }
+
+// AddHost adds a host to the network, reachable by its name and address.
+func (n *Network) AddHost(name string, addr netip.Addr) (*Host, error) {
+	addr = addr.Unmap()
+	if !addr.IsValid() || addr.IsUnspecified() {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidHostAddr, addr)
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, ok := n.names[name]; ok {
+		return nil, fmt.Errorf("%w: %q", ErrHostExists, name)
+	}
+	if _, ok := n.hosts[addr]; ok {
+		return nil, fmt.Errorf("%w: address %v already in use", ErrHostExists, addr)
+	}
+	if n.hosts == nil {
+		n.hosts = make(map[netip.Addr]*Host)
+		n.names = make(map[string]*Host)
+	}
+	h := &Host{
+		n:         n,
+		name:      name,
+		addr:      addr,
+		listeners: make(map[int]*hostListener),
+		sockets:   make(map[int]*hostPacketConn),
+		nextPort:  minEphemeralPort,
+	}
+	n.hosts[addr] = h
+	n.names[name] = h
+	return h, nil
+}
+
+// SetLink sets the profile of the link between hosts a and b, in both
+// directions.
+func (n *Network) SetLink(a, b *Host, p LinkProfile) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.links == nil {
+		n.links = make(map[hostPair]LinkProfile)
+	}
+	n.links[hostPair{a.addr, b.addr}] = p
+	n.links[hostPair{b.addr, a.addr}] = p
+}
+
+// path returns the profile of the link from one host to another, or the
+// route through the topology between them.
+//
+// Hosts that take part in the topology only reach each other through it: if
+// there is no route, path returns the reason as a non-zero errno rather than
+// falling back to the Default link.
+func (n *Network) path(from, to *Host) (LinkProfile, route, syscall.Errno) {
+	if from == to {
+		return LinkProfile{}, nil, 0
+	}
+	n.mu.Lock()
+	p, ok := n.links[hostPair{from.addr, to.addr}]
+	n.mu.Unlock()
+	if ok {
+		return p, nil, 0
+	}
+	r, errno := n.route(from, to)
+	if errno == 0 {
+		return LinkProfile{}, r, 0
+	}
+	if n.inTopology(from) || n.inTopology(to) {
+		return LinkProfile{}, nil, errno
+	}
+	return n.Default, nil, 0
+}
+
+// reachable returns nil if traffic can flow from one host to another, or
+// the reason it cannot.
+func (n *Network) reachable(from, to *Host) error {
+	if _, _, errno := n.path(from, to); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// streamProfile returns the profile of streams from one host to another.
+// Segments to an unreachable host are lost, until the connection times out.
+func (n *Network) streamProfile(from, to *Host) StreamProfile {
+	link, r, errno := n.path(from, to)
+	p := link.streamProfile()
+	p.route = r
+	if errno != 0 {
+		p.Loss = dropAll{}
+	}
+	return p
+}
+
+// packetProfile returns the profile of datagrams from one host to another.
+// Datagrams to an unreachable host are dropped.
+func (n *Network) packetProfile(from, to *Host) PacketProfile {
+	link, r, errno := n.path(from, to)
+	p := link.packetProfile()
+	p.route = r
+	if errno != 0 {
+		p.Loss = dropAll{}
+	}
+	return p
+}
+
+// dropAll is the [Loss] of a path to an unreachable host.
+type dropAll struct{}
+
+func (dropAll) Drop() bool { return true }
+
+// hostByAddr returns the host with the given address, or nil.
+func (n *Network) hostByAddr(addr netip.Addr) *Host {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.hosts[addr.Unmap()]
+}
+
+// hostByName returns the host with the given name, or nil.
+func (n *Network) hostByName(name string) *Host {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.names[name]
+}
+
+// Host is a host of a [Network], with its own stream and datagram ports.
+type Host struct {
+	n    *Network
+	name string
+	addr netip.Addr
+
+	mu        sync.Mutex
+	listeners map[int]*hostListener   // stream listeners by port
+	sockets   map[int]*hostPacketConn // datagram sockets by port
+	nextPort  int                     // next ephemeral port to try
+	routes    []hostRoute             // static routes, most specific first
+}
+
+// Name returns the name of the host.
+func (h *Host) Name() string { return h.name }
+
+// Addr returns the address of the host.
+func (h *Host) Addr() netip.Addr { return h.addr }
+
+// Listen announces on the host's address, like [net.Listen]. The network
+// must be "tcp", "tcp4" or "tcp6", and the host part of address, if any, must
+// name this host.
+func (h *Host) Listen(network, address string) (net.Listener, error) {
+	port, err := h.localPort(network, address, isTCPNetwork)
+	if err != nil {
+		return nil, &net.OpError{Op: "listen", Net: network, Err: err}
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	used := func(port int) bool { return h.listeners[port] != nil }
+	if port, err = h.bindLocked(port, used); err != nil {
+		return nil, &net.OpError{Op: "listen", Net: network, Err: err}
+	}
+	l := &hostListener{
+		h:    h,
+		addr: net.TCPAddrFromAddrPort(netip.AddrPortFrom(h.addr, uint16(port))),
+		port: port,
+		ch:   make(chan net.Conn, listenBacklog),
+		done: make(chan struct{}),
+	}
+	h.listeners[port] = l
+	return l, nil
+}
+
+// ListenPacket announces on the host's address, like [net.ListenPacket]. The
+// network must be "udp", "udp4" or "udp6", and the host part of address, if
+// any, must name this host.
+//
+// Datagrams sent to another host go through the link to that host.
+func (h *Host) ListenPacket(network, address string) (net.PacketConn, error) {
+	port, err := h.localPort(network, address, isUDPNetwork)
+	if err != nil {
+		return nil, &net.OpError{Op: "listen", Net: network, Err: err}
+	}
+	c, err := h.bind(port, nil)
+	if err != nil {
+		return nil, &net.OpError{Op: "listen", Net: network, Err: err}
+	}
+	n := h.n
+	d := &DestinationProfiles{Default: n.Default.packetProfile()}
+	d.AddFunc(func(addr net.Addr) (PacketProfile, bool) {
+		ip, ok := addrIP(addr)
+		if !ok {
+			return PacketProfile{}, false
+		}
+		dst := n.hostByAddr(ip)
+		if dst == nil {
+			return PacketProfile{}, false
+		}
+		return n.packetProfile(h, dst), true
+	})
+	return NewPacketConnPerDestination(c, d), nil
+}
+
+// Dial connects to the address on the named network, like [net.Dial].
+func (h *Host) Dial(network, address string) (net.Conn, error) {
+	return h.DialContext(context.Background(), network, address)
+}
+
+// DialContext connects to the address on the named network using the
+// provided context, like [net.Dialer.DialContext]. The host part of address
+// may be the name or address of a host, or "localhost".
+//
+// Connections are established by a [Dialer] over the link between the hosts,
+// so that dialing a stream takes one round trip, and dialing a port with no
+// listener is refused.
+func (h *Host) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	dst, _, err := h.resolve(network, address)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+	if err := h.n.reachable(h, dst); err != nil {
+		return nil, &net.OpError{
+			Op:   "dial",
+			Net:  network,
+			Addr: dialAddr{network, address},
+			Err:  os.NewSyscallError("connect", err),
+		}
+	}
+	stream := h.n.streamProfile(h, dst)
+	d := &Dialer{
+		Dialer:  hostDialer{h},
+		Stream:  stream,
+		Packet:  h.n.packetProfile(h, dst),
+		SYNLoss: stream.Loss,
+		Refuse: func(network, address string) bool {
+			_, port, err := h.resolve(network, address)
+			return err != nil || !dst.hasListener(port)
+		},
+		// Without a route back, the SYN-ACK never arrives.
+		Blackhole: func(string, string) bool { return h.n.reachable(dst, h) != nil },
+	}
+	return d.DialContext(ctx, network, address)
+}
+
+// hostDialer dials connections from a host without emulation.
+type hostDialer struct{ h *Host }
+
+func (d hostDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	h := d.h
+	dst, port, err := h.resolve(network, address)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+	raddr := netip.AddrPortFrom(dst.addr, uint16(port))
+	if isUDPNetwork(network) {
+		c, err := h.bind(0, net.UDPAddrFromAddrPort(raddr))
+		if err != nil {
+			return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+		}
+		return c, nil
+	}
+
+	dst.mu.Lock()
+	l := dst.listeners[port]
+	dst.mu.Unlock()
+	refused := &net.OpError{
+		Op:   "dial",
+		Net:  network,
+		Addr: net.TCPAddrFromAddrPort(raddr),
+		Err:  os.NewSyscallError("connect", syscall.ECONNREFUSED),
+	}
+	if l == nil {
+		return nil, refused
+	}
+	h.mu.Lock()
+	lport := h.nextEphemeralLocked(func(int) bool { return false })
+	h.mu.Unlock()
+
+	laddr := net.TCPAddrFromAddrPort(netip.AddrPortFrom(h.addr, uint16(lport)))
+	c1, c2 := net.Pipe()
+	client := &pipeConn{Conn: c1, laddr: laddr, raddr: l.addr}
+	server := &pipeConn{Conn: c2, laddr: l.addr, raddr: laddr}
+	if !l.enqueue(NewConn(server, h.n.streamProfile(dst, h))) {
+		c1.Close()
+		c2.Close()
+		return nil, refused
+	}
+	return client, nil
+}
+
+// resolve returns the host and port of a remote address.
+func (h *Host) resolve(network, address string) (*Host, int, error) {
+	if !isTCPNetwork(network) && !isUDPNetwork(network) {
+		return nil, 0, net.UnknownNetworkError(network)
+	}
+	host, port, err := splitHostPort(address)
+	if err != nil {
+		return nil, 0, err
+	}
+	var dst *Host
+	if ip, err := netip.ParseAddr(host); err == nil {
+		dst = h.n.hostByAddr(ip)
+	} else if host == "" || host == "localhost" {
+		dst = h
+	} else {
+		dst = h.n.hostByName(host)
+	}
+	if dst == nil {
+		return nil, 0, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return dst, port, nil
+}
+
+// localPort returns the port of a local address, which must name this host.
+func (h *Host) localPort(network, address string, valid func(string) bool) (int, error) {
+	if !valid(network) {
+		return 0, net.UnknownNetworkError(network)
+	}
+	host, port, err := splitHostPort(address)
+	if err != nil {
+		return 0, err
+	}
+	switch host {
+	case "", "localhost", h.name:
+		return port, nil
+	}
+	ip, err := netip.ParseAddr(host)
+	if err == nil && (ip.IsUnspecified() || ip.Unmap() == h.addr) {
+		return port, nil
+	}
+	return 0, os.NewSyscallError("bind", syscall.EADDRNOTAVAIL)
+}
+
+// bind creates a datagram socket on port, or on an ephemeral port if 0. If
+// raddr is set, the socket is connected to it.
+func (h *Host) bind(port int, raddr *net.UDPAddr) (*hostPacketConn, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	port, err := h.bindLocked(port, func(port int) bool { return h.sockets[port] != nil })
+	if err != nil {
+		return nil, err
+	}
+	c := &hostPacketConn{
+		h:     h,
+		laddr: net.UDPAddrFromAddrPort(netip.AddrPortFrom(h.addr, uint16(port))),
+		raddr: raddr,
+		port:  port,
+		in:    make(chan hostPacket, receiveBuffer),
+		done:  make(chan struct{}),
+		rd:    newDeadline(),
+	}
+	h.sockets[port] = c
+	return c, nil
+}
+
+// bindLocked returns port, or an ephemeral port if 0, unless it is used; h.mu
+// must be held.
+func (h *Host) bindLocked(port int, used func(int) bool) (int, error) {
+	if port == 0 {
+		port = h.nextEphemeralLocked(used)
+	}
+	if port == 0 || used(port) {
+		return 0, os.NewSyscallError("bind", syscall.EADDRINUSE)
+	}
+	return port, nil
+}
+
+// nextEphemeralLocked returns an unused ephemeral port, or 0 if there is none;
+// h.mu must be held.
+func (h *Host) nextEphemeralLocked(used func(int) bool) int {
+	for range maxEphemeralPort - minEphemeralPort + 1 {
+		port := h.nextPort
+		h.nextPort++
+		if h.nextPort > maxEphemeralPort {
+			h.nextPort = minEphemeralPort
+		}
+		if !used(port) {
+			return port
+		}
+	}
+	return 0
+}
+
+// hasListener reports whether a stream listener is bound to port.
+func (h *Host) hasListener(port int) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.listeners[port] != nil
+}
+
+// splitHostPort splits address into a host and a numeric port.
+func splitHostPort(address string) (string, int, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", 0, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return "", 0, &net.AddrError{Err: "invalid port", Addr: address}
+	}
+	return host, int(port), nil
+}
+
+// isTCPNetwork reports whether network is a TCP network.
+func isTCPNetwork(network string) bool {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		return true
+	}
+	return false
+}
+
+// isUDPNetwork reports whether network is a UDP network.
+func isUDPNetwork(network string) bool {
+	switch network {
+	case "udp", "udp4", "udp6":
+		return true
+	}
+	return false
+}
+
+// pipeConn is one end of a [net.Pipe] with the addresses of a host.
+type pipeConn struct {
+	net.Conn
+	laddr, raddr net.Addr
+}
+
+func (c *pipeConn) LocalAddr() net.Addr  { return c.laddr }
+func (c *pipeConn) RemoteAddr() net.Addr { return c.raddr }
+
+// hostListener is a stream listener of a [Host].
+type hostListener struct {
+	h    *Host
+	addr *net.TCPAddr
+	port int
+	ch   chan net.Conn // accept queue
+
+	mu     sync.Mutex
+	closed bool
+	done   chan struct{}
+}
+
+func (l *hostListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.ch:
+		return c, nil
+	case <-l.done:
+		return nil, l.opError("accept", net.ErrClosed)
+	}
+}
+
+func (l *hostListener) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return l.opError("close", net.ErrClosed)
+	}
+	l.closed = true
+	close(l.done)
+	l.h.mu.Lock()
+	delete(l.h.listeners, l.port)
+	l.h.mu.Unlock()
+	// Reset the connections that were never accepted.
+	for {
+		select {
+		case c := <-l.ch:
+			c.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+func (l *hostListener) Addr() net.Addr { return l.addr }
+
+func (l *hostListener) opError(op string, err error) error {
+	return &net.OpError{Op: op, Net: l.addr.Network(), Addr: l.addr, Err: err}
+}
+
+// enqueue adds c to the accept queue. It returns false if the listener is
+// closed or its backlog is full.
+func (l *hostListener) enqueue(c net.Conn) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return false
+	}
+	select {
+	case l.ch <- c:
+		return true
+	default:
+		return false
+	}
+}
+
+// hostPacket is a datagram in the receive buffer of a socket.
+type hostPacket struct {
+	data []byte
+	from *net.UDPAddr
+}
+
+// hostPacketConn is a datagram socket of a [Host]. If it was dialed, it is
+// connected to a remote address and also implements [net.Conn].
+type hostPacketConn struct {
+	h     *Host
+	laddr *net.UDPAddr
+	raddr *net.UDPAddr // remote address, if connected
+	port  int
+	in    chan hostPacket // receive buffer
+	rd    *deadline       // read deadline
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func (c *hostPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		select {
+		case p := <-c.in:
+			if c.raddr != nil && p.from.AddrPort() != c.raddr.AddrPort() {
+				// A connected socket only receives from its peer.
+				continue
+			}
+			return copy(b, p.data), p.from, nil
+		case <-c.done:
+			return 0, nil, c.opError("read", nil, net.ErrClosed)
+		case <-c.rd.wait():
+			return 0, nil, c.opError("read", nil, os.ErrDeadlineExceeded)
+		}
+	}
+}
+
+func (c *hostPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.done:
+		return 0, c.opError("write", addr, net.ErrClosed)
+	default:
+	}
+	ua, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, c.opError("write", addr, syscall.EINVAL)
+	}
+	dst := c.h.n.hostByAddr(ua.AddrPort().Addr())
+	if dst == nil {
+		// Nobody owns the address: the datagram vanishes.
+		return len(b), nil
+	}
+	dst.mu.Lock()
+	s := dst.sockets[ua.Port]
+	dst.mu.Unlock()
+	if s == nil {
+		return len(b), nil
+	}
+	select {
+	case s.in <- hostPacket{data: append([]byte(nil), b...), from: c.laddr}:
+	default:
+		// The receive buffer is full: drop the datagram.
+	}
+	return len(b), nil
+}
+
+func (c *hostPacketConn) Read(b []byte) (int, error) {
+	n, _, err := c.ReadFrom(b)
+	return n, err
+}
+
+func (c *hostPacketConn) Write(b []byte) (int, error) {
+	if c.raddr == nil {
+		return 0, c.opError("write", nil, syscall.EDESTADDRREQ)
+	}
+	return c.WriteTo(b, c.raddr)
+}
+
+func (c *hostPacketConn) Close() error {
+	err := c.opError("close", nil, net.ErrClosed)
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.h.mu.Lock()
+		delete(c.h.sockets, c.port)
+		c.h.mu.Unlock()
+		err = nil
+	})
+	return err
+}
+
+func (c *hostPacketConn) LocalAddr() net.Addr { return c.laddr }
+
+func (c *hostPacketConn) RemoteAddr() net.Addr {
+	if c.raddr == nil {
+		return nil
+	}
+	return c.raddr
+}
+
+func (c *hostPacketConn) SetDeadline(t time.Time) error {
+	c.rd.set(t)
+	return nil
+}
+
+func (c *hostPacketConn) SetReadDeadline(t time.Time) error {
+	c.rd.set(t)
+	return nil
+}
+
+// SetWriteDeadline has no effect, as writes never block.
+func (c *hostPacketConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func (c *hostPacketConn) opError(op string, addr net.Addr, err error) error {
+	if addr == nil {
+		addr = c.RemoteAddr()
+	}
+	return &net.OpError{Op: op, Net: c.laddr.Network(), Source: c.laddr, Addr: addr, Err: err}
+}
+
+// deadline is a deadline that can be waited upon.
+type deadline struct {
+	mu     sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{} // closed when the deadline expires
+}
+
+func newDeadline() *deadline {
+	return &deadline{cancel: make(chan struct{})}
+}
+
+// set sets the deadline to t, or clears it if t is zero.
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.cancel // Wait for the timer to close the channel.
+	}
+	d.timer = nil
+
+	expired := false
+	select {
+	case <-d.cancel:
+		expired = true
+	default:
+	}
+	if t.IsZero() {
+		if expired {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+	if dur := time.Until(t); dur > 0 {
+		if expired {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(dur, func() { close(cancel) })
+		return
+	}
+	if !expired {
+		close(d.cancel)
+	}
+}
+
+// wait returns a channel that is closed when the deadline expires.
+func (d *deadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cancel
+}
+
+var (
+	_ net.Listener   = (*hostListener)(nil)
+	_ net.PacketConn = (*hostPacketConn)(nil)
+	_ net.Conn       = (*hostPacketConn)(nil)
+)
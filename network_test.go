@@ -0,0 +1,160 @@
+package netem_test
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"syscall"
+	"testing"
+	"testing/synctest"
+	"time"
+
+	"github.com/kasader/netem"
+	"github.com/kasader/netem/policy"
+)
+
+// newTestNetwork returns a network with a client and a server host, linked
+// with the given one-way latency.
+func newTestNetwork(t *testing.T, latency time.Duration) (client, server *netem.Host) {
+	t.Helper()
+	n := &netem.Network{}
+	client, err := n.AddHost("client", netip.MustParseAddr("10.0.0.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err = n.AddHost("server", netip.MustParseAddr("10.0.0.2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.SetLink(client, server, netem.LinkProfile{Latency: policy.StaticLatency(latency)})
+	return client, server
+}
+
+// TestNetwork_Stream verifies that streams between hosts take one round trip
+// to establish, and that data is delayed by the link in both directions.
+func TestNetwork_Stream(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		const latency = 10 * time.Millisecond
+		client, server := newTestNetwork(t, latency)
+
+		l, err := server.Listen("tcp", ":80")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		go func() {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+			io.Copy(c, c)
+		}()
+
+		start := time.Now()
+		c, err := client.Dial("tcp", "server:80")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		if elapsed := time.Since(start); elapsed != 2*latency {
+			t.Errorf("dial took %v, want exactly %v", elapsed, 2*latency)
+		}
+		if got, want := c.RemoteAddr().String(), "10.0.0.2:80"; got != want {
+			t.Errorf("RemoteAddr is %v, want %v", got, want)
+		}
+
+		start = time.Now()
+		if _, err := c.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(c, buf); err != nil {
+			t.Fatal(err)
+		}
+		if elapsed := time.Since(start); elapsed != 2*latency {
+			t.Errorf("echo took %v, want exactly %v", elapsed, 2*latency)
+		}
+	})
+}
+
+// TestNetwork_Packet verifies that datagrams between hosts are delayed by the
+// link, for both unconnected and dialed sockets.
+func TestNetwork_Packet(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		const latency = 10 * time.Millisecond
+		client, server := newTestNetwork(t, latency)
+
+		s, err := server.ListenPacket("udp", ":53")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		c, err := client.Dial("udp", "10.0.0.2:53")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+
+		start := time.Now()
+		if _, err := c.Write([]byte("query")); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 16)
+		n, addr, err := s.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if elapsed := time.Since(start); elapsed != latency {
+			t.Errorf("datagram arrived after %v, want exactly %v", elapsed, latency)
+		}
+		if string(buf[:n]) != "query" {
+			t.Errorf("got %q, want %q", buf[:n], "query")
+		}
+
+		if _, err := s.WriteTo([]byte("answer"), addr); err != nil {
+			t.Fatal(err)
+		}
+		if n, err := c.Read(buf); err != nil || string(buf[:n]) != "answer" {
+			t.Errorf("Read returned %q, %v; want %q", buf[:n], err, "answer")
+		}
+		if elapsed := time.Since(start); elapsed != 2*latency {
+			t.Errorf("answer arrived after %v, want exactly %v", elapsed, 2*latency)
+		}
+
+		_ = s.SetReadDeadline(time.Now().Add(time.Second))
+		if _, _, err := s.ReadFrom(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("ReadFrom returned %v, want %v", err, os.ErrDeadlineExceeded)
+		}
+	})
+}
+
+// TestNetwork_Errors verifies the errors of dialing and listening.
+func TestNetwork_Errors(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		client, server := newTestNetwork(t, 10*time.Millisecond)
+
+		if _, err := client.Dial("tcp", "server:80"); !errors.Is(err, syscall.ECONNREFUSED) {
+			t.Errorf("dial returned %v, want %v", err, syscall.ECONNREFUSED)
+		}
+		var dnsErr *net.DNSError
+		_, err := client.Dial("tcp", "nowhere:80")
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			t.Errorf("dial returned %v, want a not found DNS error", err)
+		}
+
+		l, err := server.Listen("tcp", "10.0.0.2:80")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		if _, err := server.Listen("tcp", ":80"); !errors.Is(err, syscall.EADDRINUSE) {
+			t.Errorf("listen returned %v, want %v", err, syscall.EADDRINUSE)
+		}
+		if _, err := server.Listen("tcp", "10.0.0.1:80"); !errors.Is(err, syscall.EADDRNOTAVAIL) {
+			t.Errorf("listen returned %v, want %v", err, syscall.EADDRNOTAVAIL)
+		}
+	})
+}
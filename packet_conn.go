@@ -4,16 +4,26 @@ import (
 	"container/heap"
 	"net"
 	"os"
+	"slices"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 )
 
 // packetReq holds the data and the scheduled arrival time.
 type packetReq struct {
 	data []byte
+	oob  []byte // out-of-band data, written with WriteMsgUDP
 	addr net.Addr
+	size int       // size on the wire, including headers
+	sent time.Time // time the datagram entered the transmit queue
 	due  time.Time
+
+	path      *packetPath // path to the destination
+	frag      *fragGroup  // datagram this IP fragment belongs to, if any
+	fragIndex int
+	ticket    *linkPacket // the datagram waiting in a scheduled Link, due at the Link
 }
 
 // packetHeap is a Min-Heap sorted by 'due' time.
@@ -47,48 +57,149 @@ type PacketProfile struct {
 	Jitter    Jitter
 	Bandwidth Bandwidth
 	Loss      Loss
+	Corrupt   Corrupt
+	Duplicate Duplicate
+
+	// DuplicateDelay is the propagation delay of a duplicated datagram,
+	// sampled independently of Latency and Jitter so that the copy may
+	// arrive before or long after the original.
+	//
+	// Defaults to the delay of the original datagram if nil.
+	DuplicateDelay Latency
+
+	// Reorder selects datagrams that skip Latency and Jitter, so they arrive
+	// ahead of datagrams sent before them. It only has an effect if the
+	// profile has a Latency.
+	Reorder Reorder
+
+	// Oversize determines how datagrams whose payload does not fit in the
+	// MTU, minus the IP and UDP headers, are handled.
+	//
+	// Defaults to [OversizeReject].
+	Oversize Oversize
+
+	// ReassemblyTimeout is how long the receiver waits for the remaining
+	// fragments of a datagram after the first one arrived, when Oversize is
+	// [OversizeFragment].
+	//
+	// Defaults to 30s (the Linux default) if 0.
+	ReassemblyTimeout time.Duration
+
+	// Queue is the discipline of the transmit queue in which datagrams wait
+	// for the wire when Bandwidth is limited.
+	//
+	// Defaults to an unlimited [FIFO] if nil.
+	Queue Qdisc
+
+	// Clock schedules the delivery of datagrams and is used to check write
+	// deadlines. Use a [FakeClock] to run tests in fake time. With
+	// [NewPacketConnPerDestination], the Clock of the Default profile is used
+	// for every destination.
+	//
+	// Defaults to the system clock if nil.
+	Clock Clock
+
+	// Weight is the share of the Link's bandwidth each destination gets
+	// relative to other flows, if the Link's Scheduler is [DRR] or [WFQ].
+	//
+	// Defaults to 1 if 0.
+	Weight int
+
+	// Priority is the priority class of each destination, if the Link's
+	// Scheduler is [StrictPriority]. Lower values are served first.
+	Priority int
+
+	// Link attaches the connection to a [Link] shared with other
+	// connections: after the emulation above, data also crosses the Link,
+	// sharing its wire and bandwidth with all other traffic over it.
+	//
+	// Disabled if nil.
+	Link *Link
+
+	route route // Link, then the links of a Network topology
 }
 
+// Oversize determines how a [PacketConn] handles datagrams that exceed the MTU.
+type Oversize int
+
+const (
+	// OversizeReject fails the write with EMSGSIZE, like a socket sending
+	// with the "don't fragment" bit set.
+	OversizeReject Oversize = iota
+	// OversizeDrop accepts the write but silently discards the datagram, like
+	// a path that drops large packets without ICMP feedback (a PMTU black hole).
+	OversizeDrop
+	// OversizeFragment splits the datagram into IP fragments that fit in the
+	// MTU. Each fragment is subject to queueing, jitter and loss on its own,
+	// and the datagram is only delivered if every fragment arrives within
+	// the reassembly timeout.
+	OversizeFragment
+)
+
 // PacketConn wraps an existing [net.PacketConn] to emulate network conditions
 // for packet-oriented protocols.
 //
 // Unlike Conn, PacketConn allows for natural packet reordering if jitter
 // configurations cause a later packet to be scheduled for delivery earlier
-// than a previous one.
+// than a previous one. Reordering at a precise rate, without affecting the
+// latency distribution, is available through the Reorder policy.
+//
+// Datagrams are written to the underlying socket asynchronously. If that
+// fails, the error is returned once by the next WriteTo (or Close), much like
+// a kernel socket reports a pending error.
 type PacketConn struct {
 	net.PacketConn
 	headerSize    int
-	mss           int
-	p             PacketProfile
+	clock         Clock
+	path          *packetPath          // path to every destination, unless dests is set
+	dests         *DestinationProfiles // selects a path per destination, if set
+	pathMu        sync.Mutex
+	paths         map[string]*packetPath // paths by destination address
+	lastSweep     time.Time              // last eviction of idle paths
 	writeCh       chan packetReq
 	writeDeadline atomic.Value
+	errMu         sync.Mutex
+	err           error // pending error encountered by the link loop
 	stopOnce      sync.Once
 	stopCh        chan struct{}
 }
 
 // NewPacketConn wraps an existing net.PacketConn to emulate network conditions
 // for packet-oriented protocols like UDP.
+//
+// If c is a [*net.UDPConn], the returned connection is a [*UDPConn] that
+// preserves its methods.
 func NewPacketConn(c net.PacketConn, p PacketProfile) net.PacketConn {
-	headerSize := getHeaderSize(c.LocalAddr())
-	mtu := p.MTU
-	if mtu == 0 {
-		mtu = EthernetDefaultMTU
-	}
-	// Enforce minimum mss.
-	mss := max(1, int(mtu)-headerSize)
+	return newPacketConn(c, p, nil)
+}
 
+// NewPacketConnPerDestination wraps an existing net.PacketConn like
+// [NewPacketConn], but emulates a separate path to each destination, with the
+// profile selected by d. Every destination address gets its own transmit
+// queue and wire-time accounting.
+func NewPacketConnPerDestination(c net.PacketConn, d *DestinationProfiles) net.PacketConn {
+	return newPacketConn(c, d.Default, d)
+}
+
+func newPacketConn(c net.PacketConn, p PacketProfile, d *DestinationProfiles) net.PacketConn {
 	nc := &PacketConn{
 		PacketConn: c,
 		headerSize: getHeaderSize(c.LocalAddr()),
-		mss:        mss,
-		p:          p,
+		clock:      clockOrDefault(p.Clock),
+		dests:      d,
+		paths:      make(map[string]*packetPath),
 
 		// TODO: Should the WriteCh length be configurable?
 		writeCh: make(chan packetReq, 1024),
 		stopCh:  make(chan struct{}),
 	}
+	nc.path = nc.newPath(p)
 	nc.writeDeadline.Store(time.Time{})
 	go nc.linkLoop()
+
+	if uc, ok := c.(*net.UDPConn); ok {
+		return &UDPConn{PacketConn: nc, uc: uc}
+	}
 	return nc
 }
 
@@ -99,7 +210,10 @@ func (c *PacketConn) Close() error {
 			close(c.stopCh)
 		}
 	})
-	return c.PacketConn.Close()
+	if err := c.PacketConn.Close(); err != nil {
+		return err
+	}
+	return c.takeErr()
 }
 
 // SetDeadline implements net.PacketConn.
@@ -116,44 +230,98 @@ func (c *PacketConn) SetWriteDeadline(t time.Time) error {
 
 // WriteTo implements net.PacketConn.
 func (c *PacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	n, _, err = c.writeMsg(p, nil, addr)
+	return n, err
+}
+
+// writeMsg queues a datagram, along with optional out-of-band data, for
+// emulated transmission to addr.
+func (c *PacketConn) writeMsg(p, oob []byte, addr net.Addr) (n, oobn int, err error) {
 	if c.isWriteDeadline() {
-		return 0, os.ErrDeadlineExceeded
+		return 0, 0, os.ErrDeadlineExceeded
+	}
+	if err := c.takeErr(); err != nil {
+		return 0, 0, err
+	}
+	path := c.pathTo(addr)
+	if len(p) > path.mss {
+		switch path.p.Oversize {
+		case OversizeDrop:
+			return len(p), len(oob), nil
+		case OversizeFragment:
+			return c.writeFragments(path, p, oob, addr)
+		default:
+			return 0, 0, &net.OpError{
+				Op:     "write",
+				Net:    c.LocalAddr().Network(),
+				Source: c.LocalAddr(),
+				Addr:   addr,
+				Err:    os.NewSyscallError("sendto", syscall.EMSGSIZE),
+			}
+		}
 	}
-	serializationDelay := transmissionTime(c.p.Bandwidth, len(p), c.headerSize)
-	propagationDelay := delayTime(c.p.Latency, c.p.Jitter)
-
-	totalDelay := serializationDelay + propagationDelay
-	due := time.Now().Add(totalDelay)
-
 	req := packetReq{
 		data: make([]byte, len(p)),
 		addr: addr,
-		due:  due,
+		size: len(p) + c.headerSize,
+		sent: c.clock.Now(),
+		path: path,
 	}
 	copy(req.data, p)
+	if oob != nil {
+		req.oob = make([]byte, len(oob))
+		copy(req.oob, oob)
+	}
 
 	select {
 	case <-c.stopCh:
-		return c.PacketConn.WriteTo(p, addr)
+		return c.writeOut(req)
 	case c.writeCh <- req:
-		return len(p), nil
+		return len(p), len(oob), nil
 	}
 }
 
+// writeOut writes a datagram to the underlying connection.
+func (c *PacketConn) writeOut(req packetReq) (n, oobn int, err error) {
+	if req.oob != nil {
+		uc := c.PacketConn.(*net.UDPConn)
+		addr, _ := req.addr.(*net.UDPAddr)
+		if uc.RemoteAddr() != nil {
+			// Connected socket: the kernel rejects an explicit address.
+			addr = nil
+		}
+		return uc.WriteMsgUDP(req.data, req.oob, addr)
+	}
+	if conn, ok := c.PacketConn.(net.Conn); ok && req.addr == nil {
+		// Connected socket.
+		n, err = conn.Write(req.data)
+		return n, 0, err
+	}
+	n, err = c.PacketConn.WriteTo(req.data, req.addr)
+	return n, 0, err
+}
+
 var _ net.PacketConn = (*PacketConn)(nil)
 
 func (c *PacketConn) isWriteDeadline() bool {
 	wdl := c.writeDeadline.Load().(time.Time)
-	return !wdl.IsZero() && wdl.Before(time.Now())
+	return !wdl.IsZero() && wdl.Before(c.clock.Now())
 }
 
 // Handles writes in due order (scheduled).
+//
+// Datagrams first wait in the transmit queue of their path until its wire is
+// free, are serialized at the configured bandwidth, and then propagate for
+// the configured latency and jitter before being delivered.
 func (c *PacketConn) linkLoop() {
 	pq := &packetHeap{}
 	heap.Init(pq)
 
+	// Paths with datagrams waiting in their transmit queue.
+	busy := make(map[*packetPath]struct{})
+
 	// Create a timer but stop it immediately so it doesn't fire yet.
-	timer := time.NewTimer(0)
+	timer := c.clock.NewTimer(0)
 	timer.Stop()
 
 	// Ensure we clean up the timer when the loop exits.
@@ -164,36 +332,259 @@ func (c *PacketConn) linkLoop() {
 			return
 
 		case req := <-c.writeCh:
-			heap.Push(pq, req)
-			// Reset timer if this is the new head of the queue
-			if req.due.Equal((*pq)[0].due) {
-				timer.Reset(time.Until(req.due))
+			req.path.q.enqueue(&req)
+			if req.path.q.len() > 0 {
+				busy[req.path] = struct{}{}
 			}
 
-		case <-timer.C:
-			if pq.Len() == 0 {
+		case <-timer.C():
+		}
+
+		// Sleep until the next datagram is due, or a wire becomes free for
+		// the next queued datagram, whichever comes first.
+		now := c.clock.Now()
+		var next time.Time
+		for path := range busy {
+			path.transmit(pq, now)
+			if path.q.len() == 0 {
+				delete(busy, path)
 				continue
 			}
-			now := time.Now()
-			for pq.Len() > 0 {
-				next := (*pq)[0]
-				if next.due.After(now) {
-					// Next packet is in the future.
-					// Reset timer for the remainder and go back to sleep.
-					timer.Reset(next.due.Sub(now))
-					break
-				}
-				packet := heap.Pop(pq).(packetReq)
+			next = earliest(next, path.wireFree)
+		}
+		c.deliver(pq, now)
+		c.evictIdlePaths(now, busy)
+		if pq.Len() > 0 {
+			next = earliest(next, (*pq)[0].due)
+		}
+
+		timer.Stop()
+		if !next.IsZero() {
+			timer.Reset(next.Sub(now))
+		}
+	}
+}
 
-				// Apply loss policy.
-				drop := false
-				if c.p.Loss != nil {
-					drop = c.p.Loss.Drop()
+// deliver writes every datagram in pq that is due at time now.
+func (c *PacketConn) deliver(pq *packetHeap, now time.Time) {
+	for pq.Len() > 0 && !(*pq)[0].due.After(now) {
+		packet := heap.Pop(pq).(packetReq)
+		p := &packet.path.p
+
+		if packet.ticket != nil {
+			// The datagram reached a scheduled Link: wait until it leaves,
+			// then send it through the rest of the route.
+			t, done := packet.path.flow.link.resolve(packet.ticket, now)
+			if done {
+				if packet.ticket.lost {
+					continue
 				}
-				if !drop {
-					c.PacketConn.WriteTo(packet.data, packet.addr)
+				var ok bool
+				if t, ok = p.route[1:].send(now, t, packet.size); !ok {
+					continue
 				}
+				packet.ticket = nil
+			}
+			packet.due = t
+			heap.Push(pq, packet)
+			continue
+		}
+
+		// Apply loss policy.
+		drop := false
+		if p.Loss != nil {
+			drop = p.Loss.Drop()
+		}
+		if packet.frag != nil {
+			// Deliver the datagram once its last fragment arrives.
+			var complete bool
+			packet, complete = packet.frag.arrive(packet.fragIndex, drop, now)
+			if !complete {
+				continue
 			}
+		} else if drop {
+			continue
 		}
+		if p.Corrupt != nil {
+			p.Corrupt.Corrupt(packet.data)
+		}
+		if _, _, err := c.writeOut(packet); err != nil {
+			select {
+			case <-c.stopCh:
+				// Failures caused by our own Close are not worth reporting.
+			default:
+				c.storeErr(err)
+			}
+		}
+	}
+}
+
+// storeErr records err as pending, unless an error is already pending.
+func (c *PacketConn) storeErr(err error) {
+	c.errMu.Lock()
+	defer c.errMu.Unlock()
+	if c.err == nil {
+		c.err = err
+	}
+}
+
+// takeErr returns and clears the pending error, if any.
+func (c *PacketConn) takeErr() error {
+	c.errMu.Lock()
+	defer c.errMu.Unlock()
+	err := c.err
+	c.err = nil
+	return err
+}
+
+// packetPath is the emulated network path to one or more destinations: a
+// profile along with its own transmit queue and wire clock.
+type packetPath struct {
+	p   PacketProfile
+	mtu int
+	mss int // largest payload that fits in a single datagram
+
+	// Owned by the link loop.
+	q        queue
+	wireFree time.Time // when the wire finishes serializing the previous datagram
+
+	flow *linkFlow // flow in a Link with a Scheduler
+
+	lastUsed time.Time // last write through the path; guarded by pathMu
+}
+
+// pathIdleTimeout is how long the path to a destination is kept after its
+// last datagram, like the UDP timeout of connection tracking.
+const pathIdleTimeout = 2 * time.Minute
+
+func (c *PacketConn) newPath(p PacketProfile) *packetPath {
+	if p.Link != nil {
+		p.route = append(route{p.Link}, p.route...)
+	}
+	mtu := p.MTU
+	if mtu == 0 {
+		mtu = EthernetDefaultMTU
+	}
+	mtu = p.route.clampMTU(mtu)
+	// Enforce minimum mss.
+	mss := max(1, int(mtu)-c.headerSize-getTransportHeaderSize(c.LocalAddr()))
+
+	var q queue = &fifo{}
+	if p.Queue != nil {
+		q = p.Queue.newQueue()
+	}
+	path := &packetPath{p: p, mtu: int(mtu), mss: mss, q: q}
+	if p.Link != nil && p.Link.sched != nil {
+		path.flow = p.Link.attach(p.Weight, p.Priority)
+	}
+	return path
+}
+
+// pathTo returns the path to addr, creating it on first use.
+func (c *PacketConn) pathTo(addr net.Addr) *packetPath {
+	if c.dests == nil {
+		return c.path
+	}
+	key := ""
+	if addr != nil {
+		key = addr.String()
+	}
+	c.pathMu.Lock()
+	defer c.pathMu.Unlock()
+	path, ok := c.paths[key]
+	if !ok {
+		path = c.newPath(c.dests.lookup(addr))
+		c.paths[key] = path
+	}
+	path.lastUsed = c.clock.Now()
+	return path
+}
+
+// evictIdlePaths forgets the paths to destinations that have not been written
+// to for pathIdleTimeout, and whose transmit queue and wire are idle, so that
+// a long-lived socket talking to many peers does not grow without bound. It
+// runs at most once per timeout, from the link loop.
+func (c *PacketConn) evictIdlePaths(now time.Time, busy map[*packetPath]struct{}) {
+	if c.dests == nil {
+		return
+	}
+	c.pathMu.Lock()
+	defer c.pathMu.Unlock()
+	if now.Sub(c.lastSweep) < pathIdleTimeout {
+		return
+	}
+	c.lastSweep = now
+	for key, path := range c.paths {
+		_, queued := busy[path]
+		if queued || path.wireFree.After(now) || now.Sub(path.lastUsed) < pathIdleTimeout {
+			continue
+		}
+		// Datagrams of the path still propagating are delivered regardless.
+		delete(c.paths, key)
+	}
+}
+
+// transmit moves datagrams from the transmit queue onto the wire for as long
+// as the wire is free at time now, scheduling their arrival in pq.
+func (path *packetPath) transmit(pq *packetHeap, now time.Time) {
+	p := &path.p
+	for path.q.len() > 0 && !path.wireFree.After(now) {
+		packet := path.q.dequeue(now)
+		if packet == nil {
+			break
+		}
+		// Serialization starts when both the datagram and the wire are
+		// ready; starting from wireFree (rather than now) keeps throughput
+		// exact even if the loop wakes up late.
+		start := path.wireFree
+		if packet.sent.After(start) {
+			start = packet.sent
+		}
+		path.wireFree = start.Add(transmissionTime(p.Bandwidth, packet.size, 0))
+		due := path.wireFree
+		if p.Reorder == nil || !p.Reorder.Reorder() {
+			due = path.wireFree.Add(delayTime(p.Latency, p.Jitter))
+		}
+
+		// Duplicates are created after the wire, so they cross the rest of
+		// the route, and are subject to loss and corruption, independently
+		// of the original.
+		if p.Duplicate != nil && p.Duplicate.Duplicate() {
+			dup := *packet
+			dup.data = slices.Clone(packet.data)
+			dupDue := due
+			if p.DuplicateDelay != nil {
+				dupDue = path.wireFree.Add(delayTime(p.DuplicateDelay, nil))
+			}
+			path.forward(pq, now, dup, dupDue)
+		}
+		path.forward(pq, now, *packet, due)
+	}
+}
+
+// forward sends a datagram that leaves the path's own link at time due
+// through the rest of its route, then schedules its arrival in pq, unless it
+// was lost on the way.
+func (path *packetPath) forward(pq *packetHeap, now time.Time, packet packetReq, due time.Time) {
+	p := &path.p
+	packet.due = due
+	if path.flow != nil {
+		// Queue in the scheduled Link; deliver resolves the rest.
+		packet.ticket = path.flow.submit(packet.due, packet.size, 0)
+	} else if p.route != nil {
+		// Continue through every hop of the route, sharing their wires.
+		var ok bool
+		if packet.due, ok = p.route.send(now, packet.due, packet.size); !ok {
+			return
+		}
+	}
+	heap.Push(pq, packet)
+}
+
+// earliest returns the earlier of a and b, where the zero time means "never".
+func earliest(a, b time.Time) time.Time {
+	if a.IsZero() || (!b.IsZero() && b.Before(a)) {
+		return b
 	}
+	return a
 }
@@ -2,8 +2,11 @@ package netem_test
 
 import (
 	"bytes"
+	"errors"
 	"net"
+	"net/netip"
 	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
@@ -127,3 +130,403 @@ func TestPacketConn_Reordering(t *testing.T) {
 		t.Errorf("bad ordering: got %q, want %q", buf[:n], "Packet A")
 	}
 }
+
+// TestPacketConn_CoDel verifies that CoDel drops packets from a standing
+// queue, whereas the default FIFO delivers every packet eventually.
+func TestPacketConn_CoDel(t *testing.T) {
+	const count = 300
+	payload := make([]byte, 1200)
+
+	run := func(qdisc netem.Qdisc) int {
+		receiver := newLocalListener(t)
+		defer receiver.Close()
+
+		senderRaw := newLocalListener(t)
+		sender := netem.NewPacketConn(senderRaw, netem.PacketProfile{
+			Bandwidth: policy.StaticBandwidth(10_000_000), // ~1ms per packet
+			Queue:     qdisc,
+		})
+		defer sender.Close()
+
+		for range count {
+			if _, err := sender.WriteTo(payload, receiver.LocalAddr()); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		received := 0
+		buf := make([]byte, 2048)
+		for {
+			_ = receiver.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+			if _, _, err := receiver.ReadFrom(buf); err != nil {
+				return received
+			}
+			received++
+		}
+	}
+
+	if got := run(nil); got != count {
+		t.Errorf("FIFO: received %d packets, want %d", got, count)
+	}
+	got := run(netem.CoDel{Target: 5 * time.Millisecond, Interval: 20 * time.Millisecond})
+	if got == 0 || got >= count {
+		t.Errorf("CoDel: received %d packets, want some but not all of %d", got, count)
+	}
+}
+
+// TestPacketConn_FQCoDel verifies that a sparse flow is not stuck behind the
+// standing queue of a bulk flow to another destination.
+func TestPacketConn_FQCoDel(t *testing.T) {
+	bulk := newLocalListener(t)
+	defer bulk.Close()
+	sparse := newLocalListener(t)
+	defer sparse.Close()
+
+	senderRaw := newLocalListener(t)
+	sender := netem.NewPacketConn(senderRaw, netem.PacketProfile{
+		Bandwidth: policy.StaticBandwidth(10_000_000), // ~1ms per packet
+		Queue:     netem.FQCoDel{},
+	})
+	defer sender.Close()
+
+	payload := make([]byte, 1200)
+	for range 300 {
+		_, _ = sender.WriteTo(payload, bulk.LocalAddr())
+	}
+	start := time.Now()
+	if _, err := sender.WriteTo([]byte("ping"), sparse.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 2048)
+	_ = sparse.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, _, err := sparse.ReadFrom(buf); err != nil {
+		t.Fatalf("ReadFrom failed: %v", err)
+	}
+	// With a shared FIFO the ping would wait ~300ms behind the bulk flow.
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("sparse flow delayed by %v; want it to bypass the bulk queue", elapsed)
+	}
+}
+
+// TestPacketConn_AsyncError verifies that a failed delivery is reported once
+// by the next WriteTo, like a pending socket error.
+func TestPacketConn_AsyncError(t *testing.T) {
+	receiver := newLocalListener(t)
+	defer receiver.Close()
+
+	senderRaw := newLocalListener(t)
+	sender := netem.NewPacketConn(senderRaw, netem.PacketProfile{})
+	defer sender.Close()
+
+	// A *net.UDPConn cannot write to a TCP address, but WriteTo only finds
+	// out once the datagram is delivered.
+	if _, err := sender.WriteTo([]byte("bad"), &net.TCPAddr{}); err != nil {
+		t.Fatalf("WriteTo failed early: %v", err)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	if _, err := sender.WriteTo([]byte("good"), receiver.LocalAddr()); err == nil {
+		t.Error("delivery error was not reported by WriteTo")
+	}
+	if _, err := sender.WriteTo([]byte("good"), receiver.LocalAddr()); err != nil {
+		t.Errorf("error reported more than once: %v", err)
+	}
+}
+
+// TestPacketConn_Corrupt verifies that the corruption policy is applied to
+// datagrams before delivery.
+func TestPacketConn_Corrupt(t *testing.T) {
+	receiver := newLocalListener(t)
+	defer receiver.Close()
+
+	senderRaw := newLocalListener(t)
+	sender := netem.NewPacketConn(senderRaw, netem.PacketProfile{
+		Corrupt: policy.BitErrorRate(1), // flip every bit
+	})
+	defer sender.Close()
+
+	payload := []byte{0x00, 0x0F, 0xFF}
+	if _, err := sender.WriteTo(payload, receiver.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 1024)
+	_ = receiver.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, _, err := receiver.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("ReadFrom failed: %v", err)
+	}
+	if want := []byte{0xFF, 0xF0, 0x00}; !bytes.Equal(buf[:n], want) {
+		t.Errorf("got %x, want %x", buf[:n], want)
+	}
+	if !bytes.Equal(payload, []byte{0x00, 0x0F, 0xFF}) {
+		t.Error("caller's buffer was modified")
+	}
+}
+
+// TestPacketConn_Duplicate verifies that a duplicated datagram is delivered
+// twice, with the copy following its own delay.
+func TestPacketConn_Duplicate(t *testing.T) {
+	receiver := newLocalListener(t)
+	defer receiver.Close()
+
+	senderRaw := newLocalListener(t)
+	const latency = 100 * time.Millisecond
+	sender := netem.NewPacketConn(senderRaw, netem.PacketProfile{
+		Latency:        policy.StaticLatency(latency),
+		Duplicate:      policy.RandomDuplicate(1, 0),
+		DuplicateDelay: policy.StaticLatency(0),
+	})
+	defer sender.Close()
+
+	start := time.Now()
+	if _, err := sender.WriteTo([]byte("dup"), receiver.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 1024)
+	_ = receiver.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var arrivals []time.Duration
+	for range 2 {
+		n, _, err := receiver.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("ReadFrom failed: %v", err)
+		}
+		if string(buf[:n]) != "dup" {
+			t.Errorf("got %q, want %q", buf[:n], "dup")
+		}
+		arrivals = append(arrivals, time.Since(start))
+	}
+	// The undelayed copy overtakes the original.
+	if arrivals[0] >= latency/2 {
+		t.Errorf("duplicate arrived after %v; want it before the original", arrivals[0])
+	}
+	if arrivals[1] < latency {
+		t.Errorf("original arrived too fast! want >%v, got %v", latency, arrivals[1])
+	}
+}
+
+// TestPacketConn_Reorder verifies that the reorder policy sends selected
+// packets ahead of the delayed ones.
+func TestPacketConn_Reorder(t *testing.T) {
+	receiver := newLocalListener(t)
+	defer receiver.Close()
+
+	senderRaw := newLocalListener(t)
+	sender := netem.NewPacketConn(senderRaw, netem.PacketProfile{
+		Latency: policy.StaticLatency(100 * time.Millisecond),
+		// Every 2nd packet skips the delay.
+		Reorder: policy.RandomReorder(1, 0, 2),
+	})
+	defer sender.Close()
+
+	for _, payload := range []string{"A", "B", "C", "D"} {
+		_, _ = sender.WriteTo([]byte(payload), receiver.LocalAddr())
+	}
+
+	buf := make([]byte, 1024)
+	_ = receiver.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var got string
+	for range 4 {
+		n, _, err := receiver.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("ReadFrom failed: %v", err)
+		}
+		got += string(buf[:n])
+	}
+	if got != "BDAC" && got != "DBAC" && got != "BDCA" && got != "DBCA" {
+		t.Errorf("bad ordering: got %q, want B and D ahead of A and C", got)
+	}
+}
+
+// TestPacketConn_MTU verifies that datagrams larger than the MTU minus the
+// IP and UDP headers are rejected, or dropped if so configured.
+func TestPacketConn_MTU(t *testing.T) {
+	receiver := newLocalListener(t)
+	defer receiver.Close()
+
+	senderRaw := newLocalListener(t)
+	sender := netem.NewPacketConn(senderRaw, netem.PacketProfile{})
+	defer sender.Close()
+
+	const maxPayload = netem.EthernetDefaultMTU - netem.IPv4HeaderSize - netem.UDPHeaderSize
+	if _, err := sender.WriteTo(make([]byte, maxPayload), receiver.LocalAddr()); err != nil {
+		t.Errorf("WriteTo of %d bytes failed: %v", maxPayload, err)
+	}
+	_, err := sender.WriteTo(make([]byte, maxPayload+1), receiver.LocalAddr())
+	if !errors.Is(err, syscall.EMSGSIZE) {
+		t.Errorf("WriteTo of %d bytes returned %v, want EMSGSIZE", maxPayload+1, err)
+	}
+
+	droppingRaw := newLocalListener(t)
+	dropping := netem.NewPacketConn(droppingRaw, netem.PacketProfile{
+		MTU:      576,
+		Oversize: netem.OversizeDrop,
+	})
+	defer dropping.Close()
+
+	if _, err := dropping.WriteTo(make([]byte, 1000), receiver.LocalAddr()); err != nil {
+		t.Errorf("WriteTo with OversizeDrop failed: %v", err)
+	}
+	buf := make([]byte, 2048)
+	_ = receiver.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if n, _, err := receiver.ReadFrom(buf); err != nil || n != maxPayload {
+		t.Fatalf("ReadFrom returned (%d, %v); want the %d-byte datagram", n, err, maxPayload)
+	}
+	_ = receiver.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, _, err := receiver.ReadFrom(buf); err == nil {
+		t.Errorf("received a %d-byte datagram that should have been dropped", n)
+	}
+}
+
+// TestPacketConn_Fragment verifies that an oversize datagram is emulated as
+// IP fragments, and is lost if any one of its fragments is lost.
+func TestPacketConn_Fragment(t *testing.T) {
+	receiver := newLocalListener(t)
+	defer receiver.Close()
+
+	// Drop only the 2nd packet on the wire.
+	var count atomic.Int32
+	senderRaw := newLocalListener(t)
+	sender := netem.NewPacketConn(senderRaw, netem.PacketProfile{
+		MTU:      576,
+		Oversize: netem.OversizeFragment,
+		Loss:     policy.LossFunc(func() bool { return count.Add(1) == 2 }),
+	})
+	defer sender.Close()
+
+	// 2000 bytes travel as 4 fragments on a 576-byte MTU; the 2nd is lost.
+	large := bytes.Repeat([]byte("x"), 2000)
+	if _, err := sender.WriteTo(large, receiver.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sender.WriteTo([]byte("small"), receiver.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sender.WriteTo(large, receiver.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 4096)
+	_ = receiver.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for _, want := range [][]byte{[]byte("small"), large} {
+		n, _, err := receiver.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("ReadFrom failed: %v", err)
+		}
+		if !bytes.Equal(buf[:n], want) {
+			t.Errorf("got %d bytes, want %d", n, len(want))
+		}
+	}
+	if got := count.Load(); got != 9 {
+		t.Errorf("loss policy consulted %d times, want once per fragment (9)", got)
+	}
+}
+
+// TestPacketConn_FragmentDuplicateLost verifies that losing a duplicate of a
+// fragment does not prevent the reassembly of a datagram whose original
+// fragments all arrive.
+func TestPacketConn_FragmentDuplicateLost(t *testing.T) {
+	receiver := newLocalListener(t)
+	defer receiver.Close()
+
+	// Every fragment is duplicated; drop only the first copy to arrive.
+	var count atomic.Int32
+	senderRaw := newLocalListener(t)
+	sender := netem.NewPacketConn(senderRaw, netem.PacketProfile{
+		MTU:       576,
+		Oversize:  netem.OversizeFragment,
+		Latency:   policy.StaticLatency(10 * time.Millisecond),
+		Duplicate: policy.DuplicateFunc(func() bool { return true }),
+		Loss:      policy.LossFunc(func() bool { return count.Add(1) == 1 }),
+	})
+	defer sender.Close()
+
+	large := bytes.Repeat([]byte("x"), 2000)
+	if _, err := sender.WriteTo(large, receiver.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 4096)
+	_ = receiver.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, _, err := receiver.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("ReadFrom failed: %v", err)
+	}
+	if !bytes.Equal(buf[:n], large) {
+		t.Errorf("got %d bytes, want %d", n, len(large))
+	}
+}
+
+// TestPacketConn_PerDestination verifies that each destination gets the
+// profile of the most specific matching rule.
+func TestPacketConn_PerDestination(t *testing.T) {
+	near := newLocalListener(t)
+	defer near.Close()
+	far := newLocalListener(t)
+	defer far.Close()
+
+	const latency = 100 * time.Millisecond
+	dests := &netem.DestinationProfiles{}
+	dests.AddPrefix(netip.MustParsePrefix("127.0.0.0/8"), netem.PacketProfile{
+		Latency: policy.StaticLatency(latency),
+	})
+	dests.AddAddr(near.LocalAddr(), netem.PacketProfile{}) // exact match wins
+
+	senderRaw := newLocalListener(t)
+	sender := netem.NewPacketConnPerDestination(senderRaw, dests)
+	defer sender.Close()
+
+	measure := func(receiver net.PacketConn) time.Duration {
+		start := time.Now()
+		if _, err := sender.WriteTo([]byte("hi"), receiver.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 16)
+		_ = receiver.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, _, err := receiver.ReadFrom(buf); err != nil {
+			t.Fatalf("ReadFrom failed: %v", err)
+		}
+		return time.Since(start)
+	}
+
+	if d := measure(near); d >= latency/2 {
+		t.Errorf("near destination took %v; want no added latency", d)
+	}
+	if d := measure(far); d < latency {
+		t.Errorf("far destination took %v; want >%v", d, latency)
+	}
+}
+
+// TestPacketConn_FakeClock verifies that datagrams are scheduled on the
+// profile's clock, so that a long latency takes no real time.
+func TestPacketConn_FakeClock(t *testing.T) {
+	receiver := newLocalListener(t)
+	defer receiver.Close()
+
+	clock := netem.NewFakeClock(time.Now())
+	sender := netem.NewPacketConn(newLocalListener(t), netem.PacketProfile{
+		Latency: policy.StaticLatency(time.Hour),
+		Clock:   clock,
+	})
+	defer sender.Close()
+
+	if _, err := sender.WriteTo([]byte("ping"), receiver.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	clock.BlockUntil(1)
+	clock.Advance(time.Hour - time.Second)
+
+	buf := make([]byte, 16)
+	_ = receiver.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, _, err := receiver.ReadFrom(buf); err == nil {
+		t.Fatal("datagram arrived before the latency elapsed")
+	}
+
+	clock.Advance(time.Second)
+	_ = receiver.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, _, err := receiver.ReadFrom(buf); err != nil {
+		t.Fatalf("datagram did not arrive once the latency elapsed: %v", err)
+	}
+}
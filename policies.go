@@ -31,3 +31,30 @@ type Fault interface {
 	// ShouldClose returns true if the connection should be severed abruptly.
 	ShouldClose() bool
 }
+
+// Corrupt models transmission errors that damage data in flight.
+type Corrupt interface {
+	// Corrupt modifies the current datagram or segment in place.
+	Corrupt(b []byte)
+}
+
+// Duplicate models datagrams being delivered more than once.
+type Duplicate interface {
+	// Duplicate returns true if the current datagram should be emitted twice.
+	Duplicate() bool
+}
+
+// Reorder models datagrams overtaking each other on the link.
+type Reorder interface {
+	// Reorder returns true if the current datagram should skip the
+	// propagation delay, overtaking datagrams sent before it.
+	Reorder() bool
+}
+
+// ShortRead models how much of the available stream data a single Read
+// returns, like a socket delivering data in arbitrary pieces.
+type ShortRead interface {
+	// Limit returns the maximum number of bytes the next Read may return,
+	// given the stream offset of its first byte and the size of the buffer.
+	Limit(offset int64, n int) int
+}
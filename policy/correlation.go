@@ -0,0 +1,34 @@
+package policy
+
+import (
+	"math/rand/v2"
+	"sync"
+)
+
+// correlated is a source of uniformly distributed random numbers in [0, 1)
+// where each value depends on the previous one by a correlation factor.
+//
+// This mirrors the classic tc-netem generator: next = (1-ρ)·U + ρ·last, so a
+// correlation of 0 is purely random and a correlation near 1 makes
+// consecutive decisions (e.g. corrupt, duplicate) tend to repeat.
+type correlated struct {
+	mu   sync.Mutex
+	rho  float64
+	last float64
+}
+
+func newCorrelated(rho float64) *correlated {
+	return &correlated{rho: min(max(rho, 0), 1), last: rand.Float64()}
+}
+
+// Float64 returns the next correlated random number.
+func (c *correlated) Float64() float64 {
+	u := rand.Float64()
+	if c.rho == 0 {
+		return u
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.last = (1-c.rho)*u + c.rho*c.last
+	return c.last
+}
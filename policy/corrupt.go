@@ -0,0 +1,107 @@
+package policy
+
+import (
+	"math"
+	"math/rand/v2"
+	"sync/atomic"
+)
+
+// CorruptFunc enables a simple function to satisfy the [Corrupt] interface.
+type CorruptFunc func(b []byte)
+
+// Corrupt implements the [Corrupt] interface.
+func (f CorruptFunc) Corrupt(b []byte) { f(b) }
+
+// RandomCorrupt returns a function that flips a single random bit in a
+// fraction rate (0.0 to 1.0) of datagrams or segments.
+//
+// As with tc-netem's "corrupt PERCENT CORRELATION", each decision depends on
+// the previous one by the given correlation (0.0 to 1.0).
+func RandomCorrupt(rate, correlation float64) CorruptFunc {
+	rnd := newCorrelated(correlation)
+	return CorruptFunc(func(b []byte) {
+		if len(b) == 0 || rnd.Float64() >= rate {
+			return
+		}
+		bit := rand.IntN(len(b) * 8)
+		b[bit/8] ^= 1 << (bit % 8)
+	})
+}
+
+// BitErrorRate returns a function that flips every bit independently with
+// probability ber (0.0 to 1.0), like noise on a physical medium.
+func BitErrorRate(ber float64) CorruptFunc {
+	return CorruptFunc(func(b []byte) {
+		for bit := range errorPositions(len(b)*8, ber) {
+			b[bit/8] ^= 1 << (bit % 8)
+		}
+	})
+}
+
+// ByteErrorRate returns a function that replaces every byte independently
+// with probability rate (0.0 to 1.0) by a different, random value.
+func ByteErrorRate(rate float64) CorruptFunc {
+	return CorruptFunc(func(b []byte) {
+		for i := range errorPositions(len(b), rate) {
+			b[i] ^= byte(1 + rand.IntN(255))
+		}
+	})
+}
+
+// CorruptOffset returns a function that XORs the byte at offset with mask in
+// every datagram or segment long enough to contain it. A negative offset
+// counts from the end, so CorruptOffset(-1, 0x01) damages trailing checksums.
+func CorruptOffset(offset int, mask byte) CorruptFunc {
+	return CorruptFunc(func(b []byte) {
+		i := offset
+		if i < 0 {
+			i += len(b)
+		}
+		if i >= 0 && i < len(b) {
+			b[i] ^= mask
+		}
+	})
+}
+
+// errorPositions yields the positions in [0, n) hit by independent errors of
+// probability p. Gaps between errors are drawn from a geometric distribution,
+// so the cost is proportional to the number of errors rather than n.
+func errorPositions(n int, p float64) func(yield func(int) bool) {
+	return func(yield func(int) bool) {
+		if p <= 0 {
+			return
+		}
+		for i := -1; ; {
+			if p >= 1 {
+				i++
+			} else {
+				gap := math.Floor(math.Log(1-rand.Float64()) / math.Log(1-p))
+				if gap >= float64(n) {
+					return
+				}
+				i += 1 + int(gap)
+			}
+			if i >= n || !yield(i) {
+				return
+			}
+		}
+	}
+}
+
+// CorruptVar is a thread-safe, mutable [Corrupt] provider.
+// It allows you to change the corruption rate of a running simulation.
+//
+// Uses the [RandomCorrupt] policy without correlation. For other policies,
+// please implement a custom CorruptVar implementation.
+type CorruptVar struct {
+	val atomic.Uint64
+}
+
+// Set updates the corruption rate safely.
+func (v *CorruptVar) Set(rate float64) { v.val.Store(math.Float64bits(rate)) }
+
+// Corrupt implements the [Corrupt] interface.
+func (v *CorruptVar) Corrupt(b []byte) {
+	rate := math.Float64frombits(v.val.Load())
+	RandomCorrupt(rate, 0)(b)
+}
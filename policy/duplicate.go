@@ -0,0 +1,42 @@
+package policy
+
+import (
+	"math"
+	"sync/atomic"
+)
+
+// DuplicateFunc enables a simple function to satisfy the [Duplicate] interface.
+type DuplicateFunc func() bool
+
+// Duplicate implements the [Duplicate] interface.
+func (f DuplicateFunc) Duplicate() bool { return f() }
+
+// RandomDuplicate returns a function that duplicates datagrams with
+// probability rate (0.0 to 1.0).
+//
+// As with tc-netem's "duplicate PERCENT CORRELATION", each decision depends
+// on the previous one by the given correlation (0.0 to 1.0).
+func RandomDuplicate(rate, correlation float64) DuplicateFunc {
+	rnd := newCorrelated(correlation)
+	return DuplicateFunc(func() bool {
+		return rnd.Float64() < rate
+	})
+}
+
+// DuplicateVar is a thread-safe, mutable [Duplicate] provider.
+// It allows you to change the duplication rate of a running simulation.
+//
+// Uses the [RandomDuplicate] policy without correlation. For other policies,
+// please implement a custom DuplicateVar implementation.
+type DuplicateVar struct {
+	val atomic.Uint64
+}
+
+// Set updates the duplication rate safely.
+func (v *DuplicateVar) Set(rate float64) { v.val.Store(math.Float64bits(rate)) }
+
+// Duplicate implements the [Duplicate] interface.
+func (v *DuplicateVar) Duplicate() bool {
+	rate := math.Float64frombits(v.val.Load())
+	return RandomDuplicate(rate, 0)()
+}
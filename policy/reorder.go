@@ -0,0 +1,59 @@
+package policy
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+)
+
+// ReorderFunc enables a simple function to satisfy the [Reorder] interface.
+type ReorderFunc func() bool
+
+// Reorder implements the [Reorder] interface.
+func (f ReorderFunc) Reorder() bool { return f() }
+
+// RandomReorder returns a function with the semantics of tc-netem's
+// "reorder PERCENT CORRELATION gap DISTANCE": after gap-1 datagrams have been
+// delayed normally, the next one is sent immediately with probability rate
+// (0.0 to 1.0). Each decision depends on the previous one by the given
+// correlation (0.0 to 1.0).
+//
+// A gap of 0 or 1 considers every datagram for reordering.
+//
+// For example, RandomReorder(0.25, 0.5, 5) sends 25% of every 5th datagram
+// ahead of the others.
+func RandomReorder(rate, correlation float64, gap int) ReorderFunc {
+	rnd := newCorrelated(correlation)
+	gap = max(gap, 1)
+
+	var mu sync.Mutex
+	counter := 0
+	return ReorderFunc(func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		if counter < gap-1 || rnd.Float64() >= rate {
+			counter++
+			return false
+		}
+		counter = 0
+		return true
+	})
+}
+
+// ReorderVar is a thread-safe, mutable [Reorder] provider.
+// It allows you to change the reordering rate of a running simulation.
+//
+// Uses the [RandomReorder] policy without correlation or gap. For other
+// policies, please implement a custom ReorderVar implementation.
+type ReorderVar struct {
+	val atomic.Uint64
+}
+
+// Set updates the reordering rate safely.
+func (v *ReorderVar) Set(rate float64) { v.val.Store(math.Float64bits(rate)) }
+
+// Reorder implements the [Reorder] interface.
+func (v *ReorderVar) Reorder() bool {
+	rate := math.Float64frombits(v.val.Load())
+	return RandomReorder(rate, 0, 1)()
+}
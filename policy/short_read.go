@@ -0,0 +1,69 @@
+package policy
+
+import (
+	"math/rand/v2"
+	"slices"
+	"sync/atomic"
+)
+
+// ShortReadFunc enables a simple function to satisfy the [ShortRead] interface.
+type ShortReadFunc func(offset int64, n int) int
+
+// Limit implements the [ShortRead] interface.
+func (f ShortReadFunc) Limit(offset int64, n int) int { return f(offset, n) }
+
+// OneByteReads returns a function that makes every Read return a single byte.
+func OneByteReads() ShortReadFunc {
+	return FixedShortReads(1)
+}
+
+// FixedShortReads returns a function that makes every Read return at most
+// size bytes.
+func FixedShortReads(size int) ShortReadFunc {
+	return ShortReadFunc(func(int64, int) int { return size })
+}
+
+// RandomShortReads returns a function that makes every Read return a random
+// number of bytes, uniformly distributed between 1 and the buffer size.
+func RandomShortReads() ShortReadFunc {
+	return ShortReadFunc(func(_ int64, n int) int {
+		return 1 + rand.IntN(max(n, 1))
+	})
+}
+
+// SplitReads returns a function that prevents any Read from spanning one of
+// the given stream offsets, so that reads end exactly at those boundaries
+// (e.g. in the middle of a message header).
+func SplitReads(offsets ...int64) ShortReadFunc {
+	offsets = slices.Clone(offsets)
+	slices.Sort(offsets)
+	return ShortReadFunc(func(offset int64, n int) int {
+		// Find the first boundary after the current offset.
+		i, found := slices.BinarySearch(offsets, offset)
+		if found {
+			i++
+		}
+		if i == len(offsets) {
+			return n
+		}
+		return int(min(offsets[i]-offset, int64(n)))
+	})
+}
+
+// ShortReadVar is a thread-safe, mutable [ShortRead] provider.
+// It allows you to change the maximum read size of a running simulation.
+//
+// Uses the [FixedShortReads] policy; a size of 0 disables short reads. For
+// other policies, please implement a custom ShortReadVar implementation.
+type ShortReadVar struct{ val atomic.Int64 }
+
+// Set updates the maximum read size safely.
+func (v *ShortReadVar) Set(size int) { v.val.Store(int64(size)) }
+
+// Limit implements the [ShortRead] interface.
+func (v *ShortReadVar) Limit(_ int64, n int) int {
+	if size := int(v.val.Load()); size > 0 {
+		return size
+	}
+	return n
+}
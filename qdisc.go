@@ -0,0 +1,343 @@
+package netem
+
+import (
+	"cmp"
+	"math"
+	"time"
+)
+
+// Qdisc selects the queueing discipline applied to datagrams waiting for
+// transmission on a bandwidth-limited link.
+//
+// A Qdisc value is configuration only: every connection builds its own queue
+// state from it, so the same value may safely be shared between profiles.
+type Qdisc interface {
+	newQueue() queue
+}
+
+// queue is the state of a [Qdisc]. It is owned by a single link loop and is
+// therefore not safe for concurrent use.
+type queue interface {
+	// enqueue adds p to the tail of the queue. It returns false if p was
+	// dropped on arrival.
+	enqueue(p *packetReq) bool
+	// dequeue returns the next packet to transmit at time now, or nil if no
+	// packet is available. Active queue management may drop packets here.
+	dequeue(now time.Time) *packetReq
+	// len returns the number of packets currently held.
+	len() int
+}
+
+// Default parameters, matching the Linux implementations.
+const (
+	defaultCoDelTarget   = 5 * time.Millisecond
+	defaultCoDelInterval = 100 * time.Millisecond
+	defaultCoDelLimit    = 1_000
+	defaultFQCoDelLimit  = 10_240
+	defaultFQQuantum     = 1_514
+)
+
+// FIFO is a first-in, first-out queue that drops arrivals once it is full
+// (tail drop). This is the behavior of a plain router buffer, and the default
+// when no [Qdisc] is configured.
+type FIFO struct {
+	// Limit is the maximum number of queued packets.
+	//
+	// Unlimited if 0.
+	Limit int
+}
+
+func (d FIFO) newQueue() queue { return &fifo{limit: d.Limit} }
+
+// CoDel is the Controlled Delay active queue management algorithm (RFC 8289).
+// It drops packets from the head of the queue once their sojourn time has
+// stayed above Target for at least Interval.
+type CoDel struct {
+	// Target is the acceptable standing queue delay.
+	//
+	// Defaults to 5ms if 0.
+	Target time.Duration
+	// Interval is the window over which the delay must stay above Target
+	// before dropping starts. It should be on the order of the worst-case RTT.
+	//
+	// Defaults to 100ms if 0.
+	Interval time.Duration
+	// Limit is the maximum number of queued packets.
+	//
+	// Defaults to 1000 if 0.
+	Limit int
+}
+
+func (d CoDel) newQueue() queue {
+	return &codelQueue{
+		fifo:  fifo{limit: cmp.Or(d.Limit, defaultCoDelLimit)},
+		codel: newCodel(d.Target, d.Interval),
+	}
+}
+
+// FQCoDel is the Flow Queue CoDel scheduler (RFC 8290), the default qdisc of
+// most modern home routers. Each destination address gets its own queue,
+// managed by [CoDel], and queues are served by deficit round-robin with
+// priority given to sparse flows.
+type FQCoDel struct {
+	// Target is the acceptable standing queue delay of each flow.
+	//
+	// Defaults to 5ms if 0.
+	Target time.Duration
+	// Interval is the CoDel interval of each flow.
+	//
+	// Defaults to 100ms if 0.
+	Interval time.Duration
+	// Quantum is the number of bytes a flow may send per round.
+	//
+	// Defaults to 1514 if 0.
+	Quantum int
+	// Limit is the maximum number of packets held across all flows.
+	//
+	// Defaults to 10240 if 0.
+	Limit int
+}
+
+func (d FQCoDel) newQueue() queue {
+	return &fqCodelQueue{
+		target:   d.Target,
+		interval: d.Interval,
+		quantum:  cmp.Or(d.Quantum, defaultFQQuantum),
+		limit:    cmp.Or(d.Limit, defaultFQCoDelLimit),
+		flows:    make(map[string]*fqFlow),
+	}
+}
+
+// fifo is a tail-drop packet queue that also tracks its backlog in bytes.
+type fifo struct {
+	pkts  []*packetReq
+	bytes int
+	limit int
+}
+
+func (q *fifo) enqueue(p *packetReq) bool {
+	if q.limit > 0 && len(q.pkts) >= q.limit {
+		return false
+	}
+	q.pkts = append(q.pkts, p)
+	q.bytes += p.size
+	return true
+}
+
+func (q *fifo) dequeue(time.Time) *packetReq {
+	if len(q.pkts) == 0 {
+		return nil
+	}
+	p := q.pkts[0]
+	q.pkts[0] = nil
+	q.pkts = q.pkts[1:]
+	q.bytes -= p.size
+	return p
+}
+
+func (q *fifo) len() int { return len(q.pkts) }
+
+// codel holds the control state of the CoDel algorithm, as described by the
+// pseudocode in RFC 8289, Section 5.
+type codel struct {
+	target    time.Duration
+	interval  time.Duration
+	maxPacket int // largest packet seen; stands in for the link MTU
+
+	firstAboveTime time.Time
+	dropNext       time.Time
+	count          int
+	lastCount      int
+	dropping       bool
+}
+
+func newCodel(target, interval time.Duration) codel {
+	return codel{
+		target:   cmp.Or(target, defaultCoDelTarget),
+		interval: cmp.Or(interval, defaultCoDelInterval),
+	}
+}
+
+// doDequeue pops the head of q and reports whether it is ok to drop it.
+func (c *codel) doDequeue(q *fifo, now time.Time) (*packetReq, bool) {
+	p := q.dequeue(now)
+	if p == nil {
+		c.firstAboveTime = time.Time{}
+		return nil, false
+	}
+	c.maxPacket = max(c.maxPacket, p.size)
+
+	sojourn := now.Sub(p.sent)
+	if sojourn < c.target || q.bytes <= c.maxPacket {
+		// Went below target; stay below for at least one interval.
+		c.firstAboveTime = time.Time{}
+		return p, false
+	}
+	if c.firstAboveTime.IsZero() {
+		// Just went above target; start the interval.
+		c.firstAboveTime = now.Add(c.interval)
+		return p, false
+	}
+	return p, !now.Before(c.firstAboveTime)
+}
+
+// dequeue returns the next packet of q that survives the control law.
+func (c *codel) dequeue(q *fifo, now time.Time) *packetReq {
+	p, okToDrop := c.doDequeue(q, now)
+	if p == nil {
+		c.dropping = false
+		return nil
+	}
+	if c.dropping {
+		if !okToDrop {
+			// Sojourn time fell below target; leave the dropping state.
+			c.dropping = false
+		}
+		for c.dropping && !now.Before(c.dropNext) {
+			c.count++
+			p, okToDrop = c.doDequeue(q, now)
+			if p == nil || !okToDrop {
+				c.dropping = false
+			} else {
+				c.dropNext = c.controlLaw(c.dropNext)
+			}
+		}
+		return p
+	}
+	if okToDrop {
+		p, _ = c.doDequeue(q, now)
+		c.dropping = true
+		// If we were dropping recently, resume at the previous drop rate.
+		delta := c.count - c.lastCount
+		c.count = 1
+		if delta > 1 && now.Sub(c.dropNext) < 16*c.interval {
+			c.count = delta
+		}
+		c.dropNext = c.controlLaw(now)
+		c.lastCount = c.count
+	}
+	return p
+}
+
+// controlLaw returns the time of the next drop: interval/sqrt(count) after t.
+func (c *codel) controlLaw(t time.Time) time.Time {
+	return t.Add(time.Duration(float64(c.interval) / math.Sqrt(float64(c.count))))
+}
+
+// codelQueue is a single FIFO managed by CoDel.
+type codelQueue struct {
+	fifo
+	codel codel
+}
+
+func (q *codelQueue) dequeue(now time.Time) *packetReq {
+	return q.codel.dequeue(&q.fifo, now)
+}
+
+// fqFlow is the per-flow state of FQ-CoDel.
+type fqFlow struct {
+	key     string
+	q       fifo
+	codel   codel
+	deficit int
+	active  bool // flow is on the new or old list
+}
+
+// fqCodelQueue implements FQ-CoDel as described by RFC 8290, Section 4.
+type fqCodelQueue struct {
+	target   time.Duration
+	interval time.Duration
+	quantum  int
+	limit    int
+
+	flows    map[string]*fqFlow
+	newFlows []*fqFlow
+	oldFlows []*fqFlow
+	total    int
+}
+
+func (q *fqCodelQueue) enqueue(p *packetReq) bool {
+	key := ""
+	if p.addr != nil {
+		key = p.addr.String()
+	}
+	f, ok := q.flows[key]
+	if !ok {
+		f = &fqFlow{key: key, codel: newCodel(q.target, q.interval)}
+		q.flows[key] = f
+	}
+	f.q.enqueue(p)
+	q.total++
+	if !f.active {
+		f.active = true
+		f.deficit = q.quantum
+		q.newFlows = append(q.newFlows, f)
+	}
+	if q.total > q.limit {
+		// Over the limit: drop from the head of the flow with the largest
+		// backlog, which is usually the one causing the overload.
+		fattest := f
+		for _, g := range q.flows {
+			if g.q.bytes > fattest.q.bytes {
+				fattest = g
+			}
+		}
+		fattest.q.dequeue(time.Time{})
+		q.total--
+		return fattest != f || f.q.len() > 0
+	}
+	return true
+}
+
+func (q *fqCodelQueue) dequeue(now time.Time) *packetReq {
+	for {
+		var f *fqFlow
+		isNew := len(q.newFlows) > 0
+		switch {
+		case isNew:
+			f = q.newFlows[0]
+		case len(q.oldFlows) > 0:
+			f = q.oldFlows[0]
+		default:
+			return nil
+		}
+
+		if f.deficit <= 0 {
+			f.deficit += q.quantum
+			q.popFlow(isNew)
+			q.oldFlows = append(q.oldFlows, f)
+			continue
+		}
+
+		before := f.q.len()
+		p := f.codel.dequeue(&f.q, now)
+		q.total -= before - f.q.len()
+		if p == nil {
+			q.popFlow(isNew)
+			if isNew && len(q.oldFlows) > 0 {
+				// Prevent a flow from starving others by repeatedly
+				// becoming "new".
+				q.oldFlows = append(q.oldFlows, f)
+			} else {
+				f.active = false
+				delete(q.flows, f.key)
+			}
+			continue
+		}
+		f.deficit -= p.size
+		return p
+	}
+}
+
+// popFlow removes the head of the new (or old) flow list.
+func (q *fqCodelQueue) popFlow(isNew bool) {
+	if isNew {
+		q.newFlows[0] = nil
+		q.newFlows = q.newFlows[1:]
+	} else {
+		q.oldFlows[0] = nil
+		q.oldFlows = q.oldFlows[1:]
+	}
+}
+
+func (q *fqCodelQueue) len() int { return q.total }
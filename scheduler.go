@@ -0,0 +1,263 @@
+package netem
+
+import (
+	"cmp"
+	"slices"
+)
+
+// Scheduler selects the discipline with which a shared [Link] divides its
+// bandwidth between the connections attached to it. Each connection, or each
+// destination of a [PacketConn], is a separate flow, whose share is set by
+// the Weight and Priority of its profile.
+//
+// A Scheduler value is configuration only: every Link builds its own state
+// from it.
+type Scheduler interface {
+	newScheduler() scheduler
+}
+
+// scheduler is the state of a [Scheduler]. It is owned by a single Link and
+// is guarded by its mutex.
+type scheduler interface {
+	// enqueue adds p to the queue of its flow. It returns false if p was
+	// dropped on arrival.
+	enqueue(p *linkPacket) bool
+	// dequeue returns the next packet to transmit, or nil if none is queued.
+	dequeue() *linkPacket
+	// len returns the number of packets currently queued.
+	len() int
+}
+
+// newScheduler makes FIFO usable as a [Scheduler]: packets are sent in the
+// order they reach the link, regardless of their flow.
+func (d FIFO) newScheduler() scheduler { return &flowFIFO{limit: d.Limit} }
+
+// DRR is Deficit Round Robin: flows take turns, each sending up to Quantum
+// bytes, multiplied by its Weight, per round.
+type DRR struct {
+	// Quantum is the number of bytes a flow of weight 1 may send per round.
+	//
+	// Defaults to 1514 if 0.
+	Quantum int
+	// Limit is the maximum number of packets queued across all flows.
+	//
+	// Unlimited if 0.
+	Limit int
+}
+
+func (d DRR) newScheduler() scheduler {
+	return &drr{
+		flowQueues: flowQueues{limit: d.Limit},
+		quantum:    cmp.Or(d.Quantum, defaultFQQuantum),
+	}
+}
+
+// WFQ is Weighted Fair Queuing, in its self-clocked variant (SCFQ): every
+// backlogged flow gets a share of the bandwidth proportional to its Weight,
+// at the granularity of single packets.
+type WFQ struct {
+	// Limit is the maximum number of packets queued across all flows.
+	//
+	// Unlimited if 0.
+	Limit int
+}
+
+func (d WFQ) newScheduler() scheduler { return &wfq{flowQueues: flowQueues{limit: d.Limit}} }
+
+// StrictPriority always sends the packets of the flows with the lowest
+// Priority first, and those of flows of the same Priority in order of
+// arrival. Lower priority flows may starve.
+type StrictPriority struct {
+	// Limit is the maximum number of packets queued across all flows.
+	//
+	// Unlimited if 0.
+	Limit int
+}
+
+func (d StrictPriority) newScheduler() scheduler {
+	return &strictPriority{limit: d.Limit}
+}
+
+// flowFIFO is a tail-drop queue of link packets.
+type flowFIFO struct {
+	pkts  []*linkPacket
+	limit int
+}
+
+func (q *flowFIFO) enqueue(p *linkPacket) bool {
+	if q.limit > 0 && len(q.pkts) >= q.limit {
+		return false
+	}
+	q.pkts = append(q.pkts, p)
+	return true
+}
+
+func (q *flowFIFO) dequeue() *linkPacket {
+	if len(q.pkts) == 0 {
+		return nil
+	}
+	p := q.pkts[0]
+	q.pkts[0] = nil
+	q.pkts = q.pkts[1:]
+	return p
+}
+
+func (q *flowFIFO) len() int { return len(q.pkts) }
+
+// flowQueues holds a FIFO per flow, in order of activation, for the
+// schedulers that serve flows separately.
+type flowQueues struct {
+	queues map[*linkFlow]*flowQueue
+	active []*flowQueue // flows with queued packets
+	total  int
+	limit  int
+}
+
+type flowQueue struct {
+	flow    *linkFlow
+	q       flowFIFO
+	deficit int     // for DRR
+	visited bool    // for DRR: the quantum of the current round was added
+	last    float64 // for WFQ: finish tag of the last packet
+}
+
+// enqueue adds p to the queue of its flow, activating it if needed.
+func (s *flowQueues) enqueue(p *linkPacket) (*flowQueue, bool) {
+	if s.limit > 0 && s.total >= s.limit {
+		return nil, false
+	}
+	if s.queues == nil {
+		s.queues = make(map[*linkFlow]*flowQueue)
+	}
+	f, ok := s.queues[p.flow]
+	if !ok {
+		f = &flowQueue{flow: p.flow}
+		s.queues[p.flow] = f
+	}
+	if f.q.len() == 0 {
+		s.active = append(s.active, f)
+	}
+	f.q.enqueue(p)
+	s.total++
+	return f, true
+}
+
+// pop dequeues the head of the active flow at index i, deactivating and
+// forgetting the flow once it is empty.
+func (s *flowQueues) pop(i int) *linkPacket {
+	f := s.active[i]
+	p := f.q.dequeue()
+	s.total--
+	if f.q.len() == 0 {
+		// An idle flow keeps no state: it starts afresh once backlogged
+		// again, and flows of closed connections are not retained.
+		s.active = slices.Delete(s.active, i, i+1)
+		delete(s.queues, f.flow)
+	}
+	return p
+}
+
+func (s *flowQueues) len() int { return s.total }
+
+// drr implements Deficit Round Robin (Shreedhar and Varghese, 1995).
+type drr struct {
+	flowQueues
+	quantum int
+}
+
+func (s *drr) enqueue(p *linkPacket) bool {
+	_, ok := s.flowQueues.enqueue(p)
+	return ok
+}
+
+func (s *drr) dequeue() *linkPacket {
+	for len(s.active) > 0 {
+		f := s.active[0]
+		if !f.visited {
+			// The flow's turn starts: grant its quantum for this round.
+			f.deficit += s.quantum * f.flow.weight
+			f.visited = true
+		}
+		if head := f.q.pkts[0]; head.size <= f.deficit {
+			f.deficit -= head.size
+			return s.pop(0)
+		}
+		// Not enough credit left: move on to the next flow.
+		f.visited = false
+		s.active = append(s.active[1:], f)
+	}
+	return nil
+}
+
+// wfq implements Self-Clocked Fair Queuing (Golestani, 1994): each packet is
+// tagged with the virtual time at which it would finish under a fluid fair
+// share, and packets are sent in order of their tags.
+type wfq struct {
+	flowQueues
+	vtime float64 // tag of the packet in service
+}
+
+func (s *wfq) enqueue(p *linkPacket) bool {
+	f, ok := s.flowQueues.enqueue(p)
+	if !ok {
+		return false
+	}
+	p.tag = max(s.vtime, f.last) + float64(p.size)/float64(f.flow.weight)
+	f.last = p.tag
+	return true
+}
+
+func (s *wfq) dequeue() *linkPacket {
+	if len(s.active) == 0 {
+		return nil
+	}
+	// Tags increase within a flow, so the smallest tag is at a flow's head.
+	best := 0
+	for i, f := range s.active {
+		p, b := f.q.pkts[0], s.active[best].q.pkts[0]
+		if p.tag < b.tag || (p.tag == b.tag && p.seq < b.seq) {
+			best = i
+		}
+	}
+	p := s.pop(best)
+	s.vtime = p.tag
+	return p
+}
+
+// strictPriority implements [StrictPriority] with a FIFO per priority class.
+type strictPriority struct {
+	classes []priorityClass // sorted by priority
+	total   int
+	limit   int
+}
+
+type priorityClass struct {
+	priority int
+	q        *flowFIFO
+}
+
+func (s *strictPriority) enqueue(p *linkPacket) bool {
+	if s.limit > 0 && s.total >= s.limit {
+		return false
+	}
+	byPriority := func(c priorityClass, prio int) int { return cmp.Compare(c.priority, prio) }
+	i, ok := slices.BinarySearchFunc(s.classes, p.flow.priority, byPriority)
+	if !ok {
+		s.classes = slices.Insert(s.classes, i, priorityClass{p.flow.priority, &flowFIFO{}})
+	}
+	s.classes[i].q.enqueue(p)
+	s.total++
+	return true
+}
+
+func (s *strictPriority) dequeue() *linkPacket {
+	for _, c := range s.classes {
+		if p := c.q.dequeue(); p != nil {
+			s.total--
+			return p
+		}
+	}
+	return nil
+}
+
+func (s *strictPriority) len() int { return s.total }
@@ -0,0 +1,191 @@
+package netem
+
+import (
+	"net"
+	"net/netip"
+	"os"
+	"syscall"
+	"time"
+)
+
+// TCPConn is a [Conn] wrapping a [*net.TCPConn]. It preserves the socket
+// options and half-close methods of the wrapped connection, so libraries
+// that type-assert for them keep working.
+//
+// Methods that would bypass the emulated link, like ReadFrom (which may use
+// sendfile or splice), are deliberately not exposed.
+type TCPConn struct {
+	*Conn
+	tc *net.TCPConn
+}
+
+// CloseRead shuts down the reading side of the TCP connection.
+func (c *TCPConn) CloseRead() error { return c.tc.CloseRead() }
+
+// CloseWrite shuts down the writing side of the TCP connection once all data
+// written before it has been delivered.
+func (c *TCPConn) CloseWrite() error { return c.closeWrite() }
+
+// SetKeepAlive calls [net.TCPConn.SetKeepAlive] on the wrapped connection.
+func (c *TCPConn) SetKeepAlive(keepalive bool) error { return c.tc.SetKeepAlive(keepalive) }
+
+// SetKeepAlivePeriod calls [net.TCPConn.SetKeepAlivePeriod] on the wrapped connection.
+func (c *TCPConn) SetKeepAlivePeriod(d time.Duration) error { return c.tc.SetKeepAlivePeriod(d) }
+
+// SetKeepAliveConfig calls [net.TCPConn.SetKeepAliveConfig] on the wrapped connection.
+func (c *TCPConn) SetKeepAliveConfig(config net.KeepAliveConfig) error {
+	return c.tc.SetKeepAliveConfig(config)
+}
+
+// SetLinger calls [net.TCPConn.SetLinger] on the wrapped connection. It sets
+// the kernel's linger behavior only; see [StreamProfile.Linger] for the
+// emulated write queue.
+func (c *TCPConn) SetLinger(sec int) error { return c.tc.SetLinger(sec) }
+
+// SetNoDelay calls [net.TCPConn.SetNoDelay] on the wrapped connection.
+func (c *TCPConn) SetNoDelay(noDelay bool) error { return c.tc.SetNoDelay(noDelay) }
+
+// SetReadBuffer calls [net.TCPConn.SetReadBuffer] on the wrapped connection.
+func (c *TCPConn) SetReadBuffer(bytes int) error { return c.tc.SetReadBuffer(bytes) }
+
+// SetWriteBuffer calls [net.TCPConn.SetWriteBuffer] on the wrapped connection.
+func (c *TCPConn) SetWriteBuffer(bytes int) error { return c.tc.SetWriteBuffer(bytes) }
+
+// MultipathTCP calls [net.TCPConn.MultipathTCP] on the wrapped connection.
+func (c *TCPConn) MultipathTCP() (bool, error) { return c.tc.MultipathTCP() }
+
+// SyscallConn returns a raw network connection of the wrapped connection.
+// I/O performed through it is not emulated.
+func (c *TCPConn) SyscallConn() (syscall.RawConn, error) { return c.tc.SyscallConn() }
+
+// File calls [net.TCPConn.File] on the wrapped connection.
+func (c *TCPConn) File() (*os.File, error) { return c.tc.File() }
+
+// UnixConn is a [Conn] wrapping a [*net.UnixConn] of type "unix". It
+// preserves the socket options and half-close methods of the wrapped
+// connection.
+type UnixConn struct {
+	*Conn
+	uc *net.UnixConn
+}
+
+// CloseRead shuts down the reading side of the Unix domain connection.
+func (c *UnixConn) CloseRead() error { return c.uc.CloseRead() }
+
+// CloseWrite shuts down the writing side of the Unix domain connection once
+// all data written before it has been delivered.
+func (c *UnixConn) CloseWrite() error { return c.closeWrite() }
+
+// SetReadBuffer calls [net.UnixConn.SetReadBuffer] on the wrapped connection.
+func (c *UnixConn) SetReadBuffer(bytes int) error { return c.uc.SetReadBuffer(bytes) }
+
+// SetWriteBuffer calls [net.UnixConn.SetWriteBuffer] on the wrapped connection.
+func (c *UnixConn) SetWriteBuffer(bytes int) error { return c.uc.SetWriteBuffer(bytes) }
+
+// SyscallConn returns a raw network connection of the wrapped connection.
+// I/O performed through it is not emulated.
+func (c *UnixConn) SyscallConn() (syscall.RawConn, error) { return c.uc.SyscallConn() }
+
+// File calls [net.UnixConn.File] on the wrapped connection.
+func (c *UnixConn) File() (*os.File, error) { return c.uc.File() }
+
+// UDPConn is a [PacketConn] wrapping a [*net.UDPConn]. It preserves the
+// UDP-specific methods of the wrapped connection; the write methods, including
+// the message-based ones, go through the emulated link.
+type UDPConn struct {
+	*PacketConn
+	uc *net.UDPConn
+}
+
+// Read calls [net.UDPConn.Read] on the wrapped connection, which must be
+// connected (as returned by [Dialer]).
+func (c *UDPConn) Read(b []byte) (int, error) { return c.uc.Read(b) }
+
+// Write queues a datagram for emulated transmission to the remote address of
+// the wrapped connection, which must be connected (as returned by [Dialer]).
+func (c *UDPConn) Write(b []byte) (int, error) {
+	n, _, err := c.writeMsg(b, nil, nil)
+	return n, err
+}
+
+// RemoteAddr returns the remote address of the wrapped connection, if it is
+// connected.
+func (c *UDPConn) RemoteAddr() net.Addr { return c.uc.RemoteAddr() }
+
+// ReadFromUDP calls [net.UDPConn.ReadFromUDP] on the wrapped connection.
+func (c *UDPConn) ReadFromUDP(b []byte) (n int, addr *net.UDPAddr, err error) {
+	return c.uc.ReadFromUDP(b)
+}
+
+// ReadFromUDPAddrPort calls [net.UDPConn.ReadFromUDPAddrPort] on the wrapped connection.
+func (c *UDPConn) ReadFromUDPAddrPort(b []byte) (n int, addr netip.AddrPort, err error) {
+	return c.uc.ReadFromUDPAddrPort(b)
+}
+
+// ReadMsgUDP calls [net.UDPConn.ReadMsgUDP] on the wrapped connection.
+func (c *UDPConn) ReadMsgUDP(b, oob []byte) (n, oobn, flags int, addr *net.UDPAddr, err error) {
+	return c.uc.ReadMsgUDP(b, oob)
+}
+
+// ReadMsgUDPAddrPort calls [net.UDPConn.ReadMsgUDPAddrPort] on the wrapped connection.
+func (c *UDPConn) ReadMsgUDPAddrPort(
+	b, oob []byte,
+) (n, oobn, flags int, addr netip.AddrPort, err error) {
+	return c.uc.ReadMsgUDPAddrPort(b, oob)
+}
+
+// WriteToUDP acts like [UDPConn.WriteTo] but takes a [*net.UDPAddr].
+func (c *UDPConn) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	return c.WriteTo(b, addr)
+}
+
+// WriteToUDPAddrPort acts like [UDPConn.WriteTo] but takes a [netip.AddrPort].
+func (c *UDPConn) WriteToUDPAddrPort(b []byte, addr netip.AddrPort) (int, error) {
+	return c.WriteTo(b, net.UDPAddrFromAddrPort(addr))
+}
+
+// WriteMsgUDP queues a message for emulated transmission to addr, or to the
+// remote address of the wrapped connection if it is connected and addr is
+// nil. The out-of-band data is written along with the payload when it is
+// delivered.
+func (c *UDPConn) WriteMsgUDP(b, oob []byte, addr *net.UDPAddr) (n, oobn int, err error) {
+	if addr == nil {
+		// Not a nil *net.UDPAddr in a non-nil net.Addr.
+		return c.writeMsg(b, oob, nil)
+	}
+	return c.writeMsg(b, oob, addr)
+}
+
+// WriteMsgUDPAddrPort is like [UDPConn.WriteMsgUDP] but takes a [netip.AddrPort],
+// whose zero value stands for the remote address of a connected socket.
+func (c *UDPConn) WriteMsgUDPAddrPort(
+	b, oob []byte, addr netip.AddrPort,
+) (n, oobn int, err error) {
+	if !addr.IsValid() {
+		return c.writeMsg(b, oob, nil)
+	}
+	return c.writeMsg(b, oob, net.UDPAddrFromAddrPort(addr))
+}
+
+// SetReadBuffer calls [net.UDPConn.SetReadBuffer] on the wrapped connection.
+func (c *UDPConn) SetReadBuffer(bytes int) error { return c.uc.SetReadBuffer(bytes) }
+
+// SetWriteBuffer calls [net.UDPConn.SetWriteBuffer] on the wrapped connection.
+func (c *UDPConn) SetWriteBuffer(bytes int) error { return c.uc.SetWriteBuffer(bytes) }
+
+// SyscallConn returns a raw network connection of the wrapped connection.
+// I/O performed through it is not emulated.
+func (c *UDPConn) SyscallConn() (syscall.RawConn, error) { return c.uc.SyscallConn() }
+
+// File calls [net.UDPConn.File] on the wrapped connection.
+func (c *UDPConn) File() (*os.File, error) { return c.uc.File() }
+
+var (
+	_ net.Conn       = (*TCPConn)(nil)
+	_ net.Conn       = (*UnixConn)(nil)
+	_ net.PacketConn = (*UDPConn)(nil)
+	_ net.Conn       = (*UDPConn)(nil)
+	_ syscall.Conn   = (*TCPConn)(nil)
+	_ syscall.Conn   = (*UnixConn)(nil)
+	_ syscall.Conn   = (*UDPConn)(nil)
+)
@@ -0,0 +1,132 @@
+package netem_test
+
+import (
+	"net"
+	"net/netip"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/kasader/netem"
+	"github.com/kasader/netem/policy"
+)
+
+// TestTCPConn_Methods verifies that wrapping a *net.TCPConn preserves the
+// socket option methods that libraries type-assert for.
+func TestTCPConn_Methods(t *testing.T) {
+	client, server := newTCPPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	emulatedConn := netem.NewConn(client, netem.StreamProfile{})
+	defer emulatedConn.Close()
+
+	tc, ok := emulatedConn.(interface {
+		SetNoDelay(bool) error
+		SetKeepAlive(bool) error
+	})
+	if !ok {
+		t.Fatalf("%T does not implement SetNoDelay and SetKeepAlive", emulatedConn)
+	}
+	if err := tc.SetNoDelay(false); err != nil {
+		t.Errorf("SetNoDelay failed: %v", err)
+	}
+	if err := tc.SetKeepAlive(true); err != nil {
+		t.Errorf("SetKeepAlive failed: %v", err)
+	}
+	if _, ok := emulatedConn.(syscall.Conn); !ok {
+		t.Errorf("%T does not implement syscall.Conn", emulatedConn)
+	}
+}
+
+// TestUDPConn_WriteMsgUDP verifies that the message-based write paths of a
+// wrapped *net.UDPConn are emulated.
+func TestUDPConn_WriteMsgUDP(t *testing.T) {
+	receiver := newLocalListener(t)
+	defer receiver.Close()
+
+	senderRaw := newLocalListener(t)
+	const latency = 50 * time.Millisecond
+	sender, ok := netem.NewPacketConn(senderRaw, netem.PacketProfile{
+		Latency: policy.StaticLatency(latency),
+	}).(*netem.UDPConn)
+	if !ok {
+		t.Fatal("NewPacketConn(*net.UDPConn) did not return a *netem.UDPConn")
+	}
+	defer sender.Close()
+
+	start := time.Now()
+	addr := receiver.LocalAddr().(*net.UDPAddr)
+	if _, _, err := sender.WriteMsgUDP([]byte("msg"), nil, addr); err != nil {
+		t.Fatalf("WriteMsgUDP failed: %v", err)
+	}
+	if _, err := sender.WriteToUDPAddrPort([]byte("addrport"), addr.AddrPort()); err != nil {
+		t.Fatalf("WriteToUDPAddrPort failed: %v", err)
+	}
+
+	buf := make([]byte, 1024)
+	_ = receiver.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for _, want := range []string{"msg", "addrport"} {
+		n, _, err := receiver.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("ReadFrom failed: %v", err)
+		}
+		if string(buf[:n]) != want {
+			t.Errorf("got %q, want %q", buf[:n], want)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < latency {
+		t.Errorf("packets arrived too fast! want >%v, got %v", latency, elapsed)
+	}
+}
+
+// TestUDPConn_WriteMsgUDPConnected verifies that the message-based write
+// paths of a connected *net.UDPConn send to its remote address when given no
+// address.
+func TestUDPConn_WriteMsgUDPConnected(t *testing.T) {
+	receiver := newLocalListener(t)
+	defer receiver.Close()
+
+	senderRaw, err := net.DialUDP("udp", nil, receiver.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	const latency = 50 * time.Millisecond
+	sender, ok := netem.NewPacketConn(senderRaw, netem.PacketProfile{
+		Latency: policy.StaticLatency(latency),
+	}).(*netem.UDPConn)
+	if !ok {
+		t.Fatal("NewPacketConn(*net.UDPConn) did not return a *netem.UDPConn")
+	}
+	defer sender.Close()
+
+	start := time.Now()
+	if _, _, err := sender.WriteMsgUDP([]byte("msg"), nil, nil); err != nil {
+		t.Fatalf("WriteMsgUDP failed: %v", err)
+	}
+	// Empty, but non-nil, out-of-band data takes the message-based path
+	// of the wrapped connection.
+	msg, oob := []byte("addrport"), []byte{}
+	if _, _, err := sender.WriteMsgUDPAddrPort(msg, oob, netip.AddrPort{}); err != nil {
+		t.Fatalf("WriteMsgUDPAddrPort failed: %v", err)
+	}
+
+	buf := make([]byte, 1024)
+	_ = receiver.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for _, want := range []string{"msg", "addrport"} {
+		n, _, err := receiver.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("ReadFrom failed: %v", err)
+		}
+		if string(buf[:n]) != want {
+			t.Errorf("got %q, want %q", buf[:n], want)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < latency {
+		t.Errorf("packets arrived too fast! want >%v, got %v", latency, elapsed)
+	}
+	// The socket is still usable: no write failed in the background.
+	if _, err := sender.Write([]byte("write")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+}
@@ -0,0 +1,255 @@
+package netem_test
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"testing/synctest"
+	"time"
+
+	"github.com/kasader/netem"
+	"github.com/kasader/netem/policy"
+)
+
+// Inside a synctest bubble, time only advances when every goroutine is
+// durably blocked, so delays can be asserted exactly. synctest.Test also
+// fails if a goroutine started by the test is still running once it returns.
+
+// TestConn_Synctest verifies that a Conn delays data by exactly its latency
+// plus the transmission time in virtual time, and leaks no goroutines.
+func TestConn_Synctest(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		c1, c2 := net.Pipe()
+		defer c2.Close()
+
+		const latency = 100 * time.Millisecond
+		emulatedConn := netem.NewConn(c1, netem.StreamProfile{
+			Latency:   policy.StaticLatency(latency),
+			Bandwidth: policy.StaticBandwidth(80_000), // 100ms per 1000 bytes
+		})
+		defer emulatedConn.Close()
+
+		// net.Pipe addresses are not IP, so an IPv6 header is assumed.
+		data := make([]byte, 1000-netem.IPv6HeaderSize)
+		start := time.Now()
+		if _, err := emulatedConn.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(c2, make([]byte, len(data))); err != nil {
+			t.Fatal(err)
+		}
+		if elapsed, want := time.Since(start), latency+100*time.Millisecond; elapsed != want {
+			t.Errorf("data arrived after %v, want exactly %v", elapsed, want)
+		}
+	})
+}
+
+// TestConn_SynctestLinger verifies that a lingering Close waits in virtual
+// time until queued data has been delivered.
+func TestConn_SynctestLinger(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		c1, c2 := net.Pipe()
+		defer c2.Close()
+
+		const latency = time.Minute
+		emulatedConn := netem.NewConn(c1, netem.StreamProfile{
+			Latency: policy.StaticLatency(latency),
+			Linger:  -1,
+		})
+		go io.Copy(io.Discard, c2)
+
+		start := time.Now()
+		if _, err := emulatedConn.Write([]byte("bye")); err != nil {
+			t.Fatal(err)
+		}
+		if err := emulatedConn.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if elapsed := time.Since(start); elapsed != latency {
+			t.Errorf("Close returned after %v, want exactly %v", elapsed, latency)
+		}
+	})
+}
+
+// TestConn_SynctestLingerSevered verifies that a lingering Close returns
+// the error of a connection severed while draining, instead of hanging or
+// reporting discarded data.
+func TestConn_SynctestLingerSevered(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		p    netem.StreamProfile
+		want syscall.Errno
+	}{
+		{"Fault", netem.StreamProfile{
+			Fault:  policy.FaultFunc(func() bool { return true }),
+			Linger: -1,
+		}, syscall.ECONNRESET},
+		{"Loss", netem.StreamProfile{
+			Loss:   policy.LossFunc(func() bool { return true }),
+			Linger: time.Hour,
+		}, syscall.ETIMEDOUT},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			synctest.Test(t, func(t *testing.T) {
+				c1, c2 := net.Pipe()
+				defer c2.Close()
+				go io.Copy(io.Discard, c2)
+				emulatedConn := netem.NewConn(c1, tt.p)
+
+				if _, err := emulatedConn.Write([]byte("bye")); err != nil {
+					t.Fatal(err)
+				}
+				if err := emulatedConn.Close(); !errors.Is(err, tt.want) {
+					t.Errorf("Close returned %v, want %v", err, tt.want)
+				}
+			})
+		})
+	}
+}
+
+// TestConn_SynctestLossEvent verifies that the congestion window is only
+// reduced once for several segments lost in the same window.
+func TestConn_SynctestLossEvent(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		c1, c2 := net.Pipe()
+		defer c2.Close()
+
+		const latency = 100 * time.Millisecond
+		var drops int
+		emulatedConn := netem.NewConn(c1, netem.StreamProfile{
+			MTU:     1000 + netem.IPv6HeaderSize, // 1000-byte segments
+			Latency: policy.StaticLatency(latency),
+			// The first transmissions of the first three segments are lost.
+			Loss: policy.LossFunc(func() bool {
+				drops++
+				return drops <= 6 && drops%2 == 1
+			}),
+			Congestion: netem.Reno{InitialWindow: 10},
+		})
+		defer emulatedConn.Close()
+
+		// Halved once, the window still lets the sixth segment go before the
+		// retransmissions arrive; every halving more would hold it back.
+		start := time.Now()
+		for range 6 {
+			if _, err := emulatedConn.Write(make([]byte, 1000)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := io.ReadFull(c2, make([]byte, 6000)); err != nil {
+			t.Fatal(err)
+		}
+		// One-way latency, plus the RTO: a round trip and the minimum RTO.
+		want := latency + 2*latency + 200*time.Millisecond
+		if elapsed := time.Since(start); elapsed != want {
+			t.Errorf("data arrived after %v, want exactly %v", elapsed, want)
+		}
+	})
+}
+
+// TestPacketConn_Synctest verifies that a PacketConn delays datagrams by
+// exactly their latency plus queueing and transmission time in virtual time,
+// and leaks no goroutines.
+func TestPacketConn_Synctest(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		a, b := newMemPacketPair()
+		defer b.Close()
+
+		const latency = 100 * time.Millisecond
+		sender := netem.NewPacketConn(a, netem.PacketProfile{
+			Latency:   policy.StaticLatency(latency),
+			Bandwidth: policy.StaticBandwidth(80_000), // 100ms per 1000 bytes
+		})
+		defer sender.Close()
+
+		// The second datagram waits for the first one to leave the wire.
+		data := make([]byte, 1000-netem.IPv4HeaderSize)
+		start := time.Now()
+		for range 2 {
+			if _, err := sender.WriteTo(data, b.LocalAddr()); err != nil {
+				t.Fatal(err)
+			}
+		}
+		buf := make([]byte, len(data))
+		for i := range 2 {
+			if _, _, err := b.ReadFrom(buf); err != nil {
+				t.Fatal(err)
+			}
+			want := latency + time.Duration(i+1)*100*time.Millisecond
+			if elapsed := time.Since(start); elapsed != want {
+				t.Errorf("datagram %d arrived after %v, want exactly %v", i, elapsed, want)
+			}
+		}
+	})
+}
+
+// memPacketConn is an in-memory net.PacketConn whose operations block on
+// channels only, so that they are durably blocking inside a synctest bubble.
+type memPacketConn struct {
+	addr  *net.UDPAddr
+	peer  *memPacketConn
+	in    chan memPacket
+	close chan struct{}
+}
+
+type memPacket struct {
+	data []byte
+	from net.Addr
+}
+
+// newMemPacketPair returns two connected in-memory packet connections.
+func newMemPacketPair() (a, b *memPacketConn) {
+	a = &memPacketConn{
+		addr:  &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1},
+		in:    make(chan memPacket, 64),
+		close: make(chan struct{}),
+	}
+	b = &memPacketConn{
+		addr:  &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2},
+		in:    make(chan memPacket, 64),
+		close: make(chan struct{}),
+	}
+	a.peer, b.peer = b, a
+	return a, b
+}
+
+func (c *memPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	select {
+	case pkt := <-c.in:
+		return copy(p, pkt.data), pkt.from, nil
+	case <-c.close:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (c *memPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.close:
+		return 0, net.ErrClosed
+	default:
+	}
+	select {
+	case c.peer.in <- memPacket{data: append([]byte(nil), p...), from: c.addr}:
+	default:
+		// The receive buffer is full: drop the datagram.
+	}
+	return len(p), nil
+}
+
+func (c *memPacketConn) Close() error {
+	select {
+	case <-c.close:
+		return net.ErrClosed
+	default:
+		close(c.close)
+		return nil
+	}
+}
+
+func (c *memPacketConn) LocalAddr() net.Addr                { return c.addr }
+func (c *memPacketConn) SetDeadline(t time.Time) error      { return os.ErrNoDeadline }
+func (c *memPacketConn) SetReadDeadline(t time.Time) error  { return os.ErrNoDeadline }
+func (c *memPacketConn) SetWriteDeadline(t time.Time) error { return os.ErrNoDeadline }
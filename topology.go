@@ -0,0 +1,175 @@
+package netem
+
+import (
+	"cmp"
+	"net/netip"
+	"slices"
+	"syscall"
+	"time"
+)
+
+// maxHops bounds the length of a route, like the IP time-to-live.
+const maxHops = 64
+
+// Connect adds a physical link between hosts a and b to the topology of the
+// network. Each direction of the link has its own wire, shared by all traffic
+// routed over it, so that flows through a congested link queue behind each
+// other.
+//
+// Traffic between two hosts follows the links between them, using the routes
+// added with [Host.AddRoute] to find the next hop, unless SetLink was called
+// for the pair. Its delay, loss and serialization are the composition of
+// every link it traverses. Any host forwards traffic, so a router is simply
+// a host with links to several others.
+//
+// Once a host is connected, it no longer uses the Default link of the
+// network: dialing a host it has no route to (or from) fails with
+// ENETUNREACH or EHOSTUNREACH, or times out, and datagrams are dropped.
+func (n *Network) Connect(a, b *Host, p LinkProfile) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.hops == nil {
+		n.hops = make(map[hostPair]*Link)
+	}
+	n.hops[hostPair{a.addr, b.addr}] = NewLink(p)
+	n.hops[hostPair{b.addr, a.addr}] = NewLink(p)
+}
+
+// AddRoute adds a static route: traffic from h to destinations within prefix
+// is forwarded to via, which must be connected to h. Destinations directly
+// connected to h need no route, and the most specific route wins.
+func (h *Host) AddRoute(prefix netip.Prefix, via *Host) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.routes = append(h.routes, hostRoute{prefix.Masked(), via})
+	slices.SortStableFunc(h.routes, func(a, b hostRoute) int {
+		return cmp.Compare(b.prefix.Bits(), a.prefix.Bits())
+	})
+}
+
+// hostRoute is a static route of a [Host].
+type hostRoute struct {
+	prefix netip.Prefix
+	via    *Host
+}
+
+// route returns the links from one host to another. If they are not
+// connected, it returns ENETUNREACH if from has no route to the destination,
+// and EHOSTUNREACH if a host along the way cannot forward it.
+func (n *Network) route(from, to *Host) (route, syscall.Errno) {
+	var r route
+	for cur := from; len(r) < maxHops; {
+		var l *Link
+		next := n.nextHop(cur, to)
+		if next != nil {
+			n.mu.Lock()
+			l = n.hops[hostPair{cur.addr, next.addr}]
+			n.mu.Unlock()
+		}
+		if l == nil {
+			if cur == from {
+				return nil, syscall.ENETUNREACH
+			}
+			return nil, syscall.EHOSTUNREACH
+		}
+		r = append(r, l)
+		if next == to {
+			return r, 0
+		}
+		cur = next
+	}
+	return nil, syscall.EHOSTUNREACH // routing loop
+}
+
+// inTopology reports whether h has a link added with Connect.
+func (n *Network) inTopology(h *Host) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for pair := range n.hops {
+		if pair.from == h.addr {
+			return true
+		}
+	}
+	return false
+}
+
+// nextHop returns the neighbor of cur to forward traffic for dst to, or nil.
+func (n *Network) nextHop(cur, dst *Host) *Host {
+	n.mu.Lock()
+	_, direct := n.hops[hostPair{cur.addr, dst.addr}]
+	n.mu.Unlock()
+	if direct {
+		return dst
+	}
+	cur.mu.Lock()
+	defer cur.mu.Unlock()
+	for _, r := range cur.routes {
+		if r.prefix.Contains(dst.addr) {
+			return r.via
+		}
+	}
+	return nil
+}
+
+// route is the sequence of links traversed from one host to another.
+type route []*Link
+
+// clampMTU returns mtu, lowered to the smallest MTU along the route.
+func (r route) clampMTU(mtu uint) uint {
+	for _, l := range r {
+		mtu = min(mtu, l.mtu)
+	}
+	return mtu
+}
+
+// delay returns the propagation delay along the route.
+func (r route) delay() time.Duration {
+	var d time.Duration
+	for _, l := range r {
+		d += delayTime(l.p.Latency, l.p.Jitter)
+	}
+	return d
+}
+
+// drop reports whether a small packet, such as a SYN, is lost along the route.
+func (r route) drop() bool {
+	for _, l := range r {
+		if l.p.Loss != nil && l.p.Loss.Drop() {
+			return true
+		}
+	}
+	return false
+}
+
+// send sends a packet of size bytes that enters the route at time t, and
+// returns the time it reaches the destination, or false if it was lost.
+func (r route) send(now, t time.Time, size int) (time.Time, bool) {
+	for _, l := range r {
+		var ok bool
+		if t, ok = l.transmit(now, t, size); !ok {
+			return t, false
+		}
+	}
+	return t, true
+}
+
+// sendReliable sends a stream segment like send, retransmitting it from the
+// source after a timeout while it is lost, as [Conn] does. It returns the
+// time it reaches the destination, whether it was lost at least once, and
+// whether retransmissions were exhausted.
+func (r route) sendReliable(
+	now, t time.Time, size int, minRTO time.Duration,
+) (time.Time, bool, bool) {
+	rto := 2*r.delay() + minRTO
+	for i := 0; ; i++ {
+		arrival, ok := r.send(now, t, size)
+		if ok {
+			return arrival, i > 0, false
+		}
+		if i == maxRetransmits {
+			return arrival, true, true
+		}
+		t = t.Add(rto)
+		rto = min(2*rto, maxRTO)
+	}
+}
@@ -0,0 +1,186 @@
+package netem_test
+
+import (
+	"errors"
+	"net/netip"
+	"os"
+	"syscall"
+	"testing"
+	"testing/synctest"
+	"time"
+
+	"github.com/kasader/netem"
+	"github.com/kasader/netem/policy"
+)
+
+// newTestHost adds a host to n, failing the test on error.
+func newTestHost(t *testing.T, n *netem.Network, name, addr string) *netem.Host {
+	t.Helper()
+	h, err := n.AddHost(name, netip.MustParseAddr(addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+// TestNetwork_Topology verifies that the delay of traffic through a router
+// is the composition of both links, for datagrams and stream handshakes.
+func TestNetwork_Topology(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		n := &netem.Network{}
+		client := newTestHost(t, n, "client", "192.168.0.2")
+		router := newTestHost(t, n, "router", "192.168.0.1")
+		server := newTestHost(t, n, "server", "10.0.0.2")
+		n.Connect(client, router, netem.LinkProfile{
+			Latency:   policy.StaticLatency(10 * time.Millisecond),
+			Bandwidth: policy.StaticBandwidth(1_000_000), // 1ms per 125 bytes
+		})
+		n.Connect(router, server, netem.LinkProfile{
+			Latency: policy.StaticLatency(20 * time.Millisecond),
+		})
+		client.AddRoute(netip.MustParsePrefix("0.0.0.0/0"), router)
+		server.AddRoute(netip.MustParsePrefix("192.168.0.0/24"), router)
+
+		s, err := server.ListenPacket("udp", ":53")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		c, err := client.ListenPacket("udp", ":0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+
+		start := time.Now()
+		data := make([]byte, 125-netem.IPv4HeaderSize)
+		if _, err := c.WriteTo(data, s.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := s.ReadFrom(data); err != nil {
+			t.Fatal(err)
+		}
+		if elapsed, want := time.Since(start), 31*time.Millisecond; elapsed != want {
+			t.Errorf("datagram arrived after %v, want exactly %v", elapsed, want)
+		}
+
+		l, err := server.Listen("tcp", ":80")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		start = time.Now()
+		conn, err := client.Dial("tcp", "10.0.0.2:80")
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		if elapsed, want := time.Since(start), 60*time.Millisecond; elapsed != want {
+			t.Errorf("dial took %v, want exactly %v", elapsed, want)
+		}
+	})
+}
+
+// TestNetwork_SharedBottleneck verifies that flows from different hosts
+// queue behind each other on a link they share.
+func TestNetwork_SharedBottleneck(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		n := &netem.Network{}
+		a := newTestHost(t, n, "a", "192.168.0.2")
+		b := newTestHost(t, n, "b", "192.168.0.3")
+		router := newTestHost(t, n, "router", "192.168.0.1")
+		server := newTestHost(t, n, "server", "10.0.0.2")
+		n.Connect(a, router, netem.LinkProfile{})
+		n.Connect(b, router, netem.LinkProfile{})
+		n.Connect(router, server, netem.LinkProfile{
+			Bandwidth: policy.StaticBandwidth(1_000_000), // 1ms per 125 bytes
+		})
+		for _, h := range []*netem.Host{a, b} {
+			h.AddRoute(netip.MustParsePrefix("0.0.0.0/0"), router)
+		}
+
+		s, err := server.ListenPacket("udp", ":53")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+
+		start := time.Now()
+		data := make([]byte, 125-netem.IPv4HeaderSize)
+		for _, h := range []*netem.Host{a, b} {
+			c, err := h.ListenPacket("udp", ":0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			for range 2 {
+				if _, err := c.WriteTo(data, s.LocalAddr()); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		for i := range 4 {
+			if _, _, err := s.ReadFrom(data); err != nil {
+				t.Fatal(err)
+			}
+			want := time.Duration(i+1) * time.Millisecond
+			if elapsed := time.Since(start); elapsed != want {
+				t.Errorf("datagram %d arrived after %v, want exactly %v", i, elapsed, want)
+			}
+		}
+	})
+}
+
+// TestNetwork_Unreachable verifies that hosts of a topology without a route
+// between them cannot communicate, rather than using the Default link.
+func TestNetwork_Unreachable(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		n := &netem.Network{}
+		client := newTestHost(t, n, "client", "192.168.0.2")
+		router := newTestHost(t, n, "router", "192.168.0.1")
+		server := newTestHost(t, n, "server", "10.0.0.2")
+		newTestHost(t, n, "other", "172.16.0.2")
+		n.Connect(client, router, netem.LinkProfile{})
+		n.Connect(router, server, netem.LinkProfile{})
+
+		l, err := server.Listen("tcp", ":80")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		s, err := server.ListenPacket("udp", ":53")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+
+		// The client has no route to the server yet.
+		if _, err := client.Dial("tcp", "server:80"); !errors.Is(err, syscall.ENETUNREACH) {
+			t.Errorf("Dial without a route returned %v, want %v", err, syscall.ENETUNREACH)
+		}
+		c, err := client.ListenPacket("udp", ":0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		if _, err := c.WriteTo([]byte("lost"), s.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+		s.SetReadDeadline(time.Now().Add(time.Second))
+		if _, _, err := s.ReadFrom(make([]byte, 10)); !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("ReadFrom returned %v, want the datagram to be dropped", err)
+		}
+
+		// The router has no route to the other host.
+		client.AddRoute(netip.MustParsePrefix("0.0.0.0/0"), router)
+		if _, err := client.Dial("tcp", "other:80"); !errors.Is(err, syscall.EHOSTUNREACH) {
+			t.Errorf("Dial through the router returned %v, want %v", err, syscall.EHOSTUNREACH)
+		}
+
+		// The server has no route back, so the handshake never completes.
+		_, err = client.Dial("tcp", "server:80")
+		if !errors.Is(err, syscall.ETIMEDOUT) {
+			t.Errorf("Dial without a route back returned %v, want %v", err, syscall.ETIMEDOUT)
+		}
+	})
+}
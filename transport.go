@@ -0,0 +1,37 @@
+package netem
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+)
+
+// NewTransport returns an [http.Transport], cloned from
+// [http.DefaultTransport], whose connections are dialed by a [Dialer] with
+// the stream profile p.
+//
+// It lets an HTTP client talk to a server over an emulated network:
+//
+//	client := &http.Client{Transport: netem.NewTransport(profile)}
+func NewTransport(p StreamProfile) *http.Transport {
+	return NewTransportFunc(func(string) StreamProfile { return p })
+}
+
+// NewTransportFunc returns an [http.Transport] like [NewTransport], but
+// selects the profile of each connection by calling f with the address
+// ("host:port") being dialed, so that different hosts can be reached over
+// different links.
+func NewTransportFunc(f func(addr string) StreamProfile) *http.Transport {
+	// Match the dialer of http.DefaultTransport.
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		d := &Dialer{Dialer: dialer, Stream: f(addr)}
+		return d.DialContext(ctx, network, addr)
+	}
+	return t
+}
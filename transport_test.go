@@ -0,0 +1,76 @@
+package netem_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kasader/netem"
+	"github.com/kasader/netem/policy"
+)
+
+// TestTransport verifies that requests sent through the transport take at
+// least the handshake round trip plus the latency of the request.
+func TestTransport(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "pong")
+	}))
+	defer srv.Close()
+
+	const latency = 50 * time.Millisecond
+	client := &http.Client{Transport: netem.NewTransport(netem.StreamProfile{
+		Latency: policy.StaticLatency(latency),
+	})}
+	defer client.CloseIdleConnections()
+
+	start := time.Now()
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "pong" {
+		t.Errorf("got body %q, want %q", body, "pong")
+	}
+	if elapsed := time.Since(start); elapsed < 3*latency {
+		t.Errorf("Too fast! Expected >%v, got %v", 3*latency, elapsed)
+	}
+}
+
+// TestTransportFunc verifies that the profile is selected by host.
+func TestTransportFunc(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	slow := httptest.NewServer(handler)
+	defer slow.Close()
+	fast := httptest.NewServer(handler)
+	defer fast.Close()
+
+	const latency = 100 * time.Millisecond
+	client := &http.Client{Transport: netem.NewTransportFunc(func(addr string) netem.StreamProfile {
+		if strings.HasSuffix(slow.URL, addr) {
+			return netem.StreamProfile{Latency: policy.StaticLatency(latency)}
+		}
+		return netem.StreamProfile{}
+	})}
+	defer client.CloseIdleConnections()
+
+	get := func(url string) time.Duration {
+		start := time.Now()
+		resp, err := client.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return time.Since(start)
+	}
+	if d := get(fast.URL); d >= latency {
+		t.Errorf("fast host took %v; want no added latency", d)
+	}
+	if d := get(slow.URL); d < latency {
+		t.Errorf("slow host took %v; want >%v", d, latency)
+	}
+}